@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/api/validator"
+)
+
+const impersonationTokenTTL = 30 * time.Minute
+
+// outranks reports whether staff holds every permission user does. Staff
+// may only edit, delete or impersonate users they outrank, so that nobody
+// can take over an account with more access than their own.
+func (app *application) outranks(ctx context.Context, staff, user *model.User) (bool, error) {
+	staffPermissions, err := app.models.Permissions.GetAllForUser(ctx, staff.ID)
+	if err != nil {
+		return false, err
+	}
+
+	userPermissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, code := range userPermissions {
+		if !staffPermissions.Include(code) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string
+		Name        string
+		Activated   *bool
+		Deactivated *bool
+		model.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readStrings(qs, "email", "")
+	input.Name = app.readStrings(qs, "name", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Deactivated = app.readBool(qs, "deactivated", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readStrings(qs, "sort", "id")
+
+	input.Filters.SortSafeList = []string{
+		"id", "name", "email", "created_at",
+		"-id", "-name", "-email", "-created_at",
+	}
+
+	if model.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	users, metadata, err := app.models.User.GetAll(r.Context(), input.Email, input.Name, input.Activated, input.Deactivated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.outranks(r.Context(), app.contextGetUser(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Email       *string `json:"email"`
+		Activated   *bool   `json:"activated"`
+		Deactivated *bool   `json:"deactivated"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	deactivated := input.Deactivated != nil && *input.Deactivated && !user.Deactivated
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if input.Activated != nil {
+		user.Activated = *input.Activated
+	}
+	if input.Deactivated != nil {
+		user.Deactivated = *input.Deactivated
+	}
+
+	v := validator.New()
+
+	if model.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Messages)
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A deactivated user is signed out everywhere and loses their API keys,
+	// rather than keeping access until their tokens expire.
+	if deactivated {
+		err = app.models.Tokens.RevokeAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.APIKeys.DeleteAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.requestLogger(r).Info("user deactivated",
+			"user_id", user.ID,
+			"admin_id", app.contextGetUser(r).ID,
+		)
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.outranks(r.Context(), app.contextGetUser(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.closeAccount(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.requestLogger(r).Info("user account closed",
+		"user_id", user.ID,
+		"admin_id", app.contextGetUser(r).ID,
+	)
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "user account successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createImpersonationTokenHandler lets support staff act as another user to
+// reproduce a problem. The token can't be used to change the user's
+// credentials, and staff can't impersonate someone with permissions they
+// don't have themselves.
+func (app *application) createImpersonationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	staff := app.contextGetUser(r)
+
+	user, err := app.models.User.Get(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.ID == staff.ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	ok, err := app.outranks(r.Context(), staff, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.NewImpersonation(r.Context(), user.ID, staff.ID, impersonationTokenTTL, userAgent(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.requestLogger(r).Info("impersonation token issued",
+		"impersonator_id", staff.ID,
+		"user_id", user.ID,
+		"expiry", token.Expiry,
+	)
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"impersonation_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
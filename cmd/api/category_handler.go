@@ -16,7 +16,7 @@ func (app *application) createCategoryHandler(w http.ResponseWriter, r *http.Req
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		log.Println(err)
-		app.errorResponse(w, r, http.StatusBadRequest, "Invalid request payload")
+		app.errorResponse(w, r, http.StatusBadRequest, "bad_request", "Invalid request payload")
 		return
 	}
 
@@ -24,13 +24,13 @@ func (app *application) createCategoryHandler(w http.ResponseWriter, r *http.Req
 		Name: input.Name,
 	}
 
-	err = app.models.Category.Insert(category)
+	err = app.models.Category.Insert(r.Context(), category)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"category": category}, nil)
+	app.writeJSON(w, r, http.StatusCreated, envelope{"category": category}, nil)
 }
 
 func (app *application) getCategoriesList(w http.ResponseWriter, r *http.Request) {
@@ -54,17 +54,17 @@ func (app *application) getCategoriesList(w http.ResponseWriter, r *http.Request
 	}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	categories, metadata, err := app.models.Category.GetAll(input.Name, input.Filters)
+	categories, metadata, err := app.models.Category.GetAll(r.Context(), input.Name, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"categories": categories, "metadata": metadata}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"categories": categories, "metadata": metadata}, nil)
 }
 
 func (app *application) getCategoryHandler(w http.ResponseWriter, r *http.Request) {
@@ -74,7 +74,7 @@ func (app *application) getCategoryHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	category, err := app.models.Category.Get(id)
+	category, err := app.models.Category.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -85,7 +85,7 @@ func (app *application) getCategoryHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"category": category}, nil)
 }
 
 func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,7 +95,7 @@ func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	category, err := app.models.Category.Get(id)
+	category, err := app.models.Category.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -125,11 +125,11 @@ func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Req
 	v := validator.New()
 
 	if model.ValidateCategory(v, category); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	err = app.models.Category.Update(category)
+	err = app.models.Category.Update(r.Context(), category)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -140,7 +140,7 @@ func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"category": category}, nil)
 }
 
 func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
@@ -150,7 +150,7 @@ func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.models.Category.Delete(id)
+	err = app.models.Category.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -161,5 +161,5 @@ func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
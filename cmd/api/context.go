@@ -3,12 +3,23 @@ package main
 import (
 	"context"
 	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/jsonlog"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey      = contextKey("user")
+	requestIDContextKey = contextKey("request_id")
+	tokenHashContextKey = contextKey("token_hash")
+	familyContextKey    = contextKey("token_family")
+	apiKeyContextKey    = contextKey("api_key")
+	impersonatorKey     = contextKey("impersonator")
+	requestInfoKey      = contextKey("request_info")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *model.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +34,107 @@ func (app *application) contextGetUser(r *http.Request) *model.User {
 
 	return user
 }
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// logContextFields returns the request and trace IDs from a request's
+// context, for entries the model layer logs with it.
+func logContextFields(ctx context.Context) []slog.Attr {
+	var attrs []slog.Attr
+
+	if id, ok := ctx.Value(requestIDContextKey).(string); ok {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+
+	if sc := trace.SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+
+	return attrs
+}
+
+// requestLogger returns a logger that adds the request and trace IDs to
+// its entries.
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	var args []any
+	for _, attr := range logContextFields(r.Context()) {
+		args = append(args, attr)
+	}
+	return app.logger.With(args...)
+}
+
+// contextSetTokenHash stores the hash of the token the request was
+// authenticated with, so the token itself can be revoked later.
+func (app *application) contextSetTokenHash(r *http.Request, hash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenHashContextKey, hash)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetTokenHash(r *http.Request) []byte {
+	hash, _ := r.Context().Value(tokenHashContextKey).([]byte)
+	return hash
+}
+
+// contextSetTokenFamily stores the token family of a request authenticated
+// with a JWT, which has no hash of its own in the tokens table.
+func (app *application) contextSetTokenFamily(r *http.Request, family []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), familyContextKey, family)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetTokenFamily(r *http.Request) []byte {
+	family, _ := r.Context().Value(familyContextKey).([]byte)
+	return family
+}
+
+// contextSetAPIKey stores the API key a request was authenticated with.
+func (app *application) contextSetAPIKey(r *http.Request, key *model.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns nil unless the request used an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *model.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*model.APIKey)
+	return key
+}
+
+// contextSetImpersonator records the staff user acting through an
+// impersonation token.
+func (app *application) contextSetImpersonator(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetImpersonator returns 0 unless the request is impersonated.
+func (app *application) contextGetImpersonator(r *http.Request) int64 {
+	id, _ := r.Context().Value(impersonatorKey).(int64)
+	return id
+}
+
+// requestInfo collects details about a request that are only known deeper
+// in the handler chain, such as the matched route, for middleware further
+// out to log once the request is done.
+type requestInfo struct {
+	route  string
+	userID int64
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestInfo returns nil outside of the logRequest middleware.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
@@ -1,80 +1,246 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
+const problemContentType = "application/problem+json"
+
+// problem is an RFC 7807 problem details object. It is only sent to clients
+// that ask for application/problem+json; everyone else gets the older
+// {"error": ...} envelope.
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
-		"request_method": r.Method,
-		"request_url":    r.URL.String(),
-	})
+	args := []any{
+		"request_method", r.Method,
+		"request_url", r.URL.String(),
+	}
+
+	if id := app.contextGetImpersonator(r); id != 0 {
+		args = append(args, "impersonator_id", id)
+	}
+
+	trace.SpanFromContext(r.Context()).RecordError(err)
+
+	app.requestLogger(r).Error(err.Error(), args...)
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
+	var (
+		data    interface{} = envelope{"error": message}
+		headers http.Header
+	)
+
+	if acceptsProblem(r) {
+		data = app.newProblem(r, status, code, message)
+		headers = http.Header{"Content-Type": []string{problemContentType}}
+	}
 
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeJSON(w, r, status, data, headers)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+func (app *application) newProblem(r *http.Request, status int, code string, message interface{}) problem {
+	p := problem{
+		Type:      "urn:problem:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: app.contextGetRequestID(r),
+	}
+
+	switch m := message.(type) {
+	case string:
+		p.Detail = m
+	case map[string][]string:
+		p.Detail = "one or more fields failed validation"
+
+		fields := make([]string, 0, len(m))
+		for field := range m {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			for _, msg := range m[field] {
+				p.Errors = append(p.Errors, fieldError{Field: field, Message: msg})
+			}
+		}
+	default:
+		p.Detail = fmt.Sprint(m)
+	}
+
+	return p
+}
+
+// acceptsProblem reports whether the Accept header explicitly lists
+// application/problem+json.
+func acceptsProblem(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == problemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// statusClientClosedRequest is the non-standard status nginx logs for
+// requests whose client disconnected before the response. Nobody receives
+// it; it keeps such requests apart from server errors in logs and metrics.
+const statusClientClosedRequest = 499
+
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A request cancelled by the client going away, or by shutdown, fails
+	// wherever it happened to be. That is expected, not a server error.
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		app.requestLogger(r).Info("request canceled", "error", err)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, 500, message)
+	app.errorResponse(w, r, 500, "server_error", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+// failedValidationResponse takes every message recorded for each field, as
+// in Validator.Messages. A problem document lists them all; the older
+// envelope keeps its one message per field and gets the first.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string][]string) {
+	if acceptsProblem(r) {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", errors)
+		return
+	}
+
+	first := make(map[string]string, len(errors))
+	for field, messages := range errors {
+		if len(messages) > 0 {
+			first[field] = messages[0]
+		}
+	}
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", first)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("WWWW-Authenticate", "Bearer")
+	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_authentication_token", message)
+}
+
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_api_key", message)
+}
+
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or already used refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_refresh_token", message)
+}
+
+func (app *application) invalidTwoFactorCodeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid two-factor authentication code"
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_two_factor_code", message)
+}
+
+func (app *application) twoFactorConflictResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusConflict, "two_factor_conflict", message)
+}
+
+func (app *application) unverifiedEmailResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your identity provider has not verified your email address"
+	app.errorResponse(w, r, http.StatusForbidden, "unverified_email", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication_required", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "inactive_account", message)
+}
+
+func (app *application) deactivatedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated"
+	app.errorResponse(w, r, http.StatusForbidden, "deactivated_account", message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", message)
+}
+
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, "too_many_login_attempts", message)
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	message := "this account is temporarily locked after too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusLocked, "account_locked", message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "not_permitted", message)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFailedValidationResponse(t *testing.T) {
+	app := &application{}
+	errors := map[string][]string{
+		"password": {"must be at least 8 bytes long", "is too easy to guess"},
+		"email":    {"must be provided"},
+	}
+
+	t.Run("problem", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+		r.Header.Set("Accept", problemContentType)
+		w := httptest.NewRecorder()
+		app.failedValidationResponse(w, r, errors)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d", w.Code)
+		}
+
+		var p problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []fieldError{
+			{"email", "must be provided"},
+			{"password", "must be at least 8 bytes long"},
+			{"password", "is too easy to guess"},
+		}
+		if !reflect.DeepEqual(p.Errors, want) {
+			t.Errorf("got errors %v; want %v", p.Errors, want)
+		}
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+		w := httptest.NewRecorder()
+		app.failedValidationResponse(w, r, errors)
+
+		var body struct {
+			Error map[string]string `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"email":    "must be provided",
+			"password": "must be at least 8 bytes long",
+		}
+		if !reflect.DeepEqual(body.Error, want) {
+			t.Errorf("got %v; want %v", body.Error, want)
+		}
+	})
+}
+
+func TestInvalidAuthenticationTokenResponse(t *testing.T) {
+	app := &application{}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/me", nil)
+	w := httptest.NewRecorder()
+	app.invalidAuthenticationTokenResponse(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+		t.Errorf("got WWW-Authenticate %q", got)
+	}
+}
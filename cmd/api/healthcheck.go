@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -11,10 +18,200 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 			"environment": app.config.env,
 			"version":     version,
 		},
+		"database": dbPoolStats(app.db),
 	}
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.writeJSON(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		// Use the new serverErrorResponse() helper.
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// livenessHandler only reports that the process is serving requests. It
+// checks no dependencies, so that an outage elsewhere doesn't get the API
+// restarted.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// healthCheck is the outcome of checking one dependency. Its status is
+// "up", "down", or "unknown" when there was nothing to check.
+type healthCheck struct {
+	Status   string                 `json:"status"`
+	Duration float64                `json:"duration_ms"`
+	Error    string                 `json:"error,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+
+	// Critical dependencies make the API unavailable when they are down;
+	// the others only make it degraded.
+	critical bool
+}
+
+const healthCheckTimeout = 2 * time.Second
+
+// readinessHandler reports whether the API should be sent traffic: not
+// while draining for shutdown, nor while a critical dependency is down.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := app.checkDependencies(r.Context())
+
+	status := "ready"
+	for _, check := range checks {
+		if check.Status != "down" {
+			continue
+		}
+		if check.critical {
+			status = "unavailable"
+			break
+		}
+		status = "degraded"
+	}
+
+	if app.draining.Load() {
+		status = "draining"
+	}
+
+	code := http.StatusOK
+	if status == "unavailable" || status == "draining" {
+		code = http.StatusServiceUnavailable
+	}
+
+	err := app.writeJSON(w, r, code, envelope{"status": status, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkDependencies runs the dependency checks concurrently, each with a
+// timeout.
+func (app *application) checkDependencies(ctx context.Context) map[string]*healthCheck {
+	type checkFunc struct {
+		critical bool
+		fn       func(ctx context.Context) (map[string]interface{}, error)
+	}
+
+	// Without -migrations there is no expected version, so the schema can
+	// only be found broken, not too old, and that alone doesn't stop
+	// traffic.
+	funcs := map[string]checkFunc{
+		"database":   {critical: true, fn: app.checkDatabase},
+		"migrations": {critical: app.migrationVersion != 0, fn: app.checkMigrations},
+	}
+
+	if pinger, ok := app.limiter.store.(interface{ Ping(context.Context) error }); ok && app.limiter.enabled {
+		funcs["rate_limiter"] = checkFunc{fn: func(ctx context.Context) (map[string]interface{}, error) {
+			return nil, pinger.Ping(ctx)
+		}}
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]*healthCheck, len(funcs))
+	)
+
+	for name, f := range funcs {
+		wg.Add(1)
+
+		go func(name string, f checkFunc) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			details, err := f.fn(ctx)
+
+			check := &healthCheck{
+				Status:   "up",
+				Duration: float64(time.Since(start).Microseconds()) / 1000,
+				Details:  details,
+				critical: f.critical,
+			}
+			switch {
+			case errors.Is(err, errMigrationsUnknown):
+				check.Status = "unknown"
+				check.Error = err.Error()
+			case err != nil:
+				check.Status = "down"
+				check.Error = err.Error()
+			}
+
+			mu.Lock()
+			checks[name] = check
+			mu.Unlock()
+		}(name, f)
+	}
+
+	wg.Wait()
+
+	return checks
+}
+
+func (app *application) checkDatabase(ctx context.Context) (map[string]interface{}, error) {
+	return dbPoolStats(app.db), app.db.PingContext(ctx)
+}
+
+// dbPoolStats describes the database connection pool, to help tell whether
+// it is sized well: waits mean it is too small, and connections closed for
+// being idle that it is too large.
+func dbPoolStats(db *sql.DB) map[string]interface{} {
+	stats := db.Stats()
+
+	return map[string]interface{}{
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	}
+}
+
+var (
+	errMigrationsDirty  = errors.New("the last migration failed and the schema needs fixing by hand")
+	errMigrationsBehind = errors.New("the schema is older than the migrations this version expects")
+
+	// errMigrationsUnknown is returned when migrate has never run against
+	// the database, such as when the schema was created some other way.
+	errMigrationsUnknown = errors.New("no schema version recorded: schema_migrations doesn't exist")
+)
+
+// checkMigrations checks the schema version recorded by migrate. When the
+// migrations are known, the schema must be at least at the latest one, so
+// that a new version isn't sent traffic before its migrations have run.
+func (app *application) checkMigrations(ctx context.Context) (map[string]interface{}, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := app.db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42P01" { // undefined_table
+			return nil, errMigrationsUnknown
+		}
+		return nil, err
+	}
+
+	details := map[string]interface{}{"version": version}
+
+	if app.migrationVersion != 0 {
+		details["expected"] = app.migrationVersion
+	}
+
+	switch {
+	case dirty:
+		return details, errMigrationsDirty
+	case version < int64(app.migrationVersion):
+		return details, errMigrationsBehind
+	}
+
+	return details, nil
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"github.com/godra-y/go-project/pkg/api/validator"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
 )
@@ -27,8 +29,15 @@ func (app *application) readIDParam(r *http.Request) (int, error) {
 	return id, nil
 }
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers http.Header) error {
+	// Encoding gets a span of its own, since large responses can take a
+	// noticeable part of the request.
+	_, span := tracer.Start(r.Context(), "writeJSON")
 	js, err := json.MarshalIndent(data, "", "\t")
+	span.SetAttributes(attribute.Int("json.bytes", len(js)))
+	span.RecordError(err)
+	span.End()
+
 	if err != nil {
 		return err
 	}
@@ -36,7 +45,9 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
-	w.Header().Set("Content-Type", "application/json")
+	if headers.Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	w.Write(js)
 	return nil
@@ -120,3 +131,42 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	return i
 }
+
+// readBool returns nil when the key is absent, so callers can tell "not
+// given" apart from false.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// background runs fn in a goroutine tracked by app.wg, so that serve() waits
+// for it during shutdown. Panics are logged rather than crashing the server.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+	app.metrics.background.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+		defer app.metrics.background.Add(-1)
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.metrics.panics.Add(1)
+				app.logger.Error(fmt.Sprintf("panic: %v", err), "stack", string(debug.Stack()))
+			}
+		}()
+
+		fn()
+	}()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/jwt"
+)
+
+// userClaims are the claims carried by access tokens in JWT mode. The name,
+// email and activation are there for clients; authenticate() only trusts
+// the subject and session, and loads the user from the database.
+type userClaims struct {
+	jwt.RegisteredClaims
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Activated bool   `json:"activated"`
+	Session   string `json:"sid"`
+}
+
+func (app *application) newAccessJWT(user *model.User, family []byte) (*model.Token, error) {
+	expiry := time.Now().Add(app.config.tokens.accessTTL)
+
+	claims := &userClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			ExpiresAt: expiry.Unix(),
+		},
+		Name:      user.Name,
+		Email:     user.Email,
+		Activated: user.Activated,
+		Session:   hex.EncodeToString(family),
+	}
+
+	signed, err := app.jwt.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     model.ScopeAuthentication,
+		Family:    family,
+	}, nil
+}
+
+// verifyJWT verifies a JWT access token and returns the ID of the user it
+// was issued to along with its token family.
+func (app *application) verifyJWT(token string) (int64, []byte, error) {
+	var claims userClaims
+
+	err := app.jwt.Verify(token, &claims)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return 0, nil, errors.New("jwt: invalid subject")
+	}
+
+	family, err := hex.DecodeString(claims.Session)
+	if err != nil || len(family) == 0 {
+		return 0, nil, errors.New("jwt: invalid session")
+	}
+
+	return id, family, nil
+}
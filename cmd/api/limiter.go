@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// activationLimit allows three activation emails per address an hour.
+var activationLimit = ratelimit.Limit{Rate: 3.0 / 3600, Burst: 3}
+
+// rateLimiter holds the request rate limits. Routes listed in routes, keyed
+// like "POST /api/v1/users/login", get a bucket of their own; every other
+// route shares a bucket per client with the default limit.
+type rateLimiter struct {
+	enabled bool
+	store   ratelimit.Store
+	limit   ratelimit.Limit
+	routes  map[string]ratelimit.Limit
+}
+
+// parseRouteLimits parses a comma-separated list of route limits such as
+// "POST /api/v1/users/login=0.2:5", where 0.2 is the rate in requests per
+// second and 5 the burst.
+func parseRouteLimits(spec string) (map[string]ratelimit.Limit, error) {
+	routes := make(map[string]ratelimit.Limit)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route, value, ok := strings.Cut(entry, "=")
+		rate, burst, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 || len(strings.Fields(route)) != 2 {
+			return nil, fmt.Errorf("invalid route limit %q", entry)
+		}
+
+		limit, err := newLimit(rate, burst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route limit %q: %w", entry, err)
+		}
+
+		routes[strings.Join(strings.Fields(route), " ")] = limit
+	}
+
+	return routes, nil
+}
+
+func newLimit(rate, burst string) (ratelimit.Limit, error) {
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r <= 0 {
+		return ratelimit.Limit{}, fmt.Errorf("rate must be a positive number")
+	}
+
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 1 {
+		return ratelimit.Limit{}, fmt.Errorf("burst must be a positive integer")
+	}
+
+	return ratelimit.Limit{Rate: r, Burst: b}, nil
+}
+
+// rateLimit is router middleware, so that the matched route is known.
+// Authenticated requests are limited per user and anonymous ones per client
+// IP. If the store can't be reached the request is let through.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bucket, limit := "default", app.limiter.limit
+
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				if l, ok := app.limiter.routes[r.Method+" "+template]; ok {
+					bucket, limit = r.Method+" "+template, l
+				}
+			}
+		}
+
+		client := "ip:" + app.clientIP(r)
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			client = "user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		result, err := app.limiter.store.Take(r.Context(), bucket+"|"+client, limit)
+		if err != nil {
+			app.logError(r, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, ceilSeconds(limit.Window())))
+
+		if !result.Allowed {
+			setRetryAfter(w, result.RetryAfter)
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// parseTrustedProxies parses IP addresses and CIDR ranges.
+func parseTrustedProxies(specs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		if !strings.Contains(spec, "/") {
+			addr, err := netip.ParseAddr(spec)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func (app *application) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range app.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, without the port. When the
+// request comes from a trusted proxy, X-Forwarded-For is read from the right,
+// skipping further trusted proxies, since only the entries they added can be
+// believed.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+
+		ip = hop
+		if !app.trustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
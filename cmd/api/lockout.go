@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/model"
+)
+
+const (
+	// Accounts are locked after this many consecutive failed logins, for one
+	// minute at first and doubling with each further failure.
+	accountLockThreshold = 5
+	accountLockBase      = time.Minute
+	accountLockMax       = time.Hour
+	accountFailureWindow = 24 * time.Hour
+
+	// Addresses are allowed more failures, since they may be shared, but
+	// back off the same way.
+	ipBlockThreshold = 20
+	ipBlockBase      = time.Second
+	ipBlockMax       = 15 * time.Minute
+	ipFailureWindow  = 15 * time.Minute
+
+	failurePruneInterval = time.Minute
+)
+
+// backoff returns base doubled once for every failure past threshold,
+// capped at max.
+func backoff(failures, threshold int, base, max time.Duration) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	d := time.Duration(float64(base) * math.Pow(2, float64(failures-threshold)))
+	if d > max || d <= 0 {
+		return max
+	}
+	return d
+}
+
+// failureCounter counts failed logins per key, such as a client address, in
+// memory, blocking a key for growing periods once it reaches the threshold.
+type failureCounter struct {
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	window    time.Duration
+
+	mu     sync.Mutex
+	keys   map[string]*failureCount
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+type failureCount struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func newFailureCounter(threshold int, base, max, window time.Duration) *failureCounter {
+	f := &failureCounter{
+		threshold: threshold,
+		base:      base,
+		max:       max,
+		window:    window,
+		keys:      make(map[string]*failureCount),
+		ticker:    time.NewTicker(failurePruneInterval),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case now := <-f.ticker.C:
+				f.prune(now)
+			case <-f.done:
+				return
+			}
+		}
+	}()
+
+	return f
+}
+
+// newIPFailures counts failed logins per client address.
+func newIPFailures() *failureCounter {
+	return newFailureCounter(ipBlockThreshold, ipBlockBase, ipBlockMax, ipFailureWindow)
+}
+
+// newUnknownEmailFailures counts failed logins for email addresses without
+// an account, and locks them out just as the database locks out accounts,
+// so that a lockout doesn't reveal which addresses have one.
+func newUnknownEmailFailures() *failureCounter {
+	return newFailureCounter(accountLockThreshold, accountLockBase, accountLockMax, accountFailureWindow)
+}
+
+// Close stops pruning.
+func (f *failureCounter) Close() {
+	f.ticker.Stop()
+	close(f.done)
+}
+
+// prune forgets keys that are no longer blocked and haven't failed within
+// the window. It runs on a timer rather than on each failure, so that a
+// flood of failures doesn't mean a scan of every key each time.
+func (f *failureCounter) prune(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k, c := range f.keys {
+		if now.Sub(c.lastFailure) > f.window && now.After(c.blockedUntil) {
+			delete(f.keys, k)
+		}
+	}
+}
+
+// Blocked reports how long key must wait before trying again, or zero.
+func (f *failureCounter) Blocked(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.keys[key]
+	if !ok {
+		return 0
+	}
+
+	if remaining := time.Until(c.blockedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Fail records a failed login for key.
+func (f *failureCounter) Fail(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	// A key not yet pruned starts over like one that was.
+	c, ok := f.keys[key]
+	if !ok || (now.Sub(c.lastFailure) > f.window && now.After(c.blockedUntil)) {
+		c = &failureCount{}
+		f.keys[key] = c
+	}
+
+	c.count++
+	c.lastFailure = now
+	if d := backoff(c.count, f.threshold, f.base, f.max); d > 0 {
+		c.blockedUntil = now.Add(d)
+	}
+}
+
+// recordLoginFailure counts a wrong password against the account and
+// locks it once the threshold is reached.
+func (app *application) recordLoginFailure(ctx context.Context, userID int64) error {
+	lockout, err := app.models.Lockouts.RecordFailure(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	d := backoff(lockout.Failures, accountLockThreshold, accountLockBase, accountLockMax)
+	if d == 0 {
+		return nil
+	}
+
+	return app.models.Lockouts.Lock(ctx, userID, time.Now().Add(d))
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Lockouts.Reset(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "user account unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
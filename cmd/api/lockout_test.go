@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{8, 8 * time.Minute},
+		{11, time.Hour},
+		{200, time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := backoff(tt.failures, accountLockThreshold, accountLockBase, accountLockMax)
+		if got != tt.want {
+			t.Errorf("backoff(%d) = %s; want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestIPFailures(t *testing.T) {
+	f := newIPFailures()
+	defer f.Close()
+
+	for i := 1; i < ipBlockThreshold; i++ {
+		f.Fail("192.0.2.1")
+	}
+	if wait := f.Blocked("192.0.2.1"); wait != 0 {
+		t.Fatalf("blocked for %s below the threshold", wait)
+	}
+
+	f.Fail("192.0.2.1")
+	if wait := f.Blocked("192.0.2.1"); wait <= 0 || wait > ipBlockBase {
+		t.Errorf("blocked for %s at the threshold; want up to %s", wait, ipBlockBase)
+	}
+
+	if wait := f.Blocked("192.0.2.2"); wait != 0 {
+		t.Errorf("other address blocked for %s", wait)
+	}
+}
+
+func TestIPFailuresPrune(t *testing.T) {
+	f := newIPFailures()
+	defer f.Close()
+	now := time.Now()
+
+	f.keys["stale"] = &failureCount{count: 3, lastFailure: now.Add(-ipFailureWindow - time.Second)}
+	f.keys["recent"] = &failureCount{count: 3, lastFailure: now.Add(-time.Minute)}
+	f.keys["blocked"] = &failureCount{
+		count:        30,
+		lastFailure:  now.Add(-ipFailureWindow - time.Second),
+		blockedUntil: now.Add(time.Minute),
+	}
+
+	f.prune(now)
+
+	for ip, want := range map[string]bool{"stale": false, "recent": true, "blocked": true} {
+		if _, ok := f.keys[ip]; ok != want {
+			t.Errorf("%s kept: %t; want %t", ip, ok, want)
+		}
+	}
+}
+
+func TestIPFailuresStaleEntryStartsOver(t *testing.T) {
+	f := newIPFailures()
+	defer f.Close()
+
+	f.keys["192.0.2.1"] = &failureCount{
+		count:       ipBlockThreshold + 5,
+		lastFailure: time.Now().Add(-ipFailureWindow - time.Second),
+	}
+
+	f.Fail("192.0.2.1")
+
+	if got := f.keys["192.0.2.1"].count; got != 1 {
+		t.Errorf("got count %d; want 1", got)
+	}
+	if wait := f.Blocked("192.0.2.1"); wait != 0 {
+		t.Errorf("blocked for %s after a stale entry", wait)
+	}
+}
+
+func TestUnknownEmailFailures(t *testing.T) {
+	f := newUnknownEmailFailures()
+	defer f.Close()
+
+	// Unknown addresses are locked after as many failures as accounts, and
+	// for as long.
+	for i := 1; i < accountLockThreshold; i++ {
+		f.Fail("nobody@example.com")
+	}
+	if wait := f.Blocked("nobody@example.com"); wait != 0 {
+		t.Fatalf("blocked for %s below the threshold", wait)
+	}
+
+	f.Fail("nobody@example.com")
+	if wait := f.Blocked("nobody@example.com"); wait <= accountLockBase-time.Second || wait > accountLockBase {
+		t.Errorf("blocked for %s at the threshold; want %s", wait, accountLockBase)
+	}
+}
+
+func TestFailureCounterClose(t *testing.T) {
+	f := newFailureCounter(1, time.Second, time.Second, time.Minute)
+	f.Close()
+
+	// Counting still works once pruning has stopped.
+	f.Fail("key")
+	if f.Blocked("key") == 0 {
+		t.Error("not blocked after Close")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/godra-y/go-project/pkg/jsonlog"
+)
+
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"level": app.logger.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLogLevelHandler changes the log level until the next restart, for
+// instance to turn on debug logging while looking into a problem.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(err == nil && level != jsonlog.LevelFatal, "level", "must be one of debug, info, warn, error or off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	app.logger.Warn("log level changed", "from", previous.String(), "to", level.String())
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"level": level.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "net/http"
+
+// mailSender sends a templated email to a single recipient. data is passed to
+// the template as-is.
+type mailSender interface {
+	Send(recipient, templateName string, data interface{}) error
+}
+
+// logMailer records emails in the application log instead of delivering
+// them. Only the recipient and template are logged: the data holds tokens
+// that must not end up in logs. Use MailHog to read the emails themselves.
+type logMailer struct {
+	app *application
+}
+
+func (m logMailer) Send(recipient, templateName string, data interface{}) error {
+	m.app.logger.Info("email not delivered, no mailer configured",
+		"recipient", recipient,
+		"template", templateName,
+	)
+	return nil
+}
+
+// sendEmail sends an email in the background, after the response. A failure
+// is logged with the request and trace IDs and the user it was for, since
+// the request itself has finished by then.
+func (app *application) sendEmail(r *http.Request, userID int64, recipient, templateName string, data map[string]interface{}) {
+	logger := app.requestLogger(r).With("user_id", userID, "template", templateName)
+
+	app.background(func() {
+		err := app.mailer.Send(recipient, templateName, data)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	})
+}
@@ -1,20 +1,40 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	_ "fmt"
 	"github.com/godra-y/go-project/pkg/api/model"
 	"github.com/godra-y/go-project/pkg/jsonlog"
+	"github.com/godra-y/go-project/pkg/jwt"
+	"github.com/godra-y/go-project/pkg/mailer"
+	"github.com/godra-y/go-project/pkg/oidc"
+	"github.com/godra-y/go-project/pkg/ratelimit"
 	"github.com/godra-y/go-project/pkg/vcs"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
 	"github.com/peterbourgon/ff/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log/slog"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -23,18 +43,100 @@ var (
 
 type config struct {
 	port       int
+	adminHost  string
+	adminPort  int
+	drainDelay time.Duration
 	env        string
 	migrations string
-	db         struct {
-		dsn string
+	log        struct {
+		level            string
+		sampleFirst      int
+		sampleThereafter int
+	}
+	db struct {
+		dsn            string
+		queryTimeout   time.Duration
+		maxOpenConns   int
+		maxIdleConns   int
+		maxLifetime    time.Duration
+		maxIdleTime    time.Duration
+		pingTimeout    time.Duration
+		connectTimeout time.Duration
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	auth struct {
+		mode string
+	}
+	jwt struct {
+		issuer       string
+		audience     string
+		keys         []string
+		signingKeyID string
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+	passwords struct {
+		hasher            string
+		bcryptCost        int
+		argon2Memory      int
+		argon2Iterations  int
+		argon2Parallelism int
+		minLength         int
+		minScore          int
+		breachedDir       string
+	}
+	limiter struct {
+		enabled  bool
+		rps      float64
+		burst    int
+		routes   string
+		store    string
+		redisURL string
+	}
+	trustedProxies []string
+	cors           struct {
+		trustedOrigins []string
+	}
+	tracing struct {
+		endpoint    string
+		sampleRatio float64
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
 	}
 }
 
 type application struct {
-	config config
-	models model.Models
-	logger *jsonlog.Logger
-	wg     sync.WaitGroup
+	config  config
+	db      *sql.DB
+	models  model.Models
+	logger  *jsonlog.Logger
+	mailer  mailSender
+	jwt     *jwt.Manager
+	oidc    *oidc.Provider
+	metrics *metrics
+	wg      sync.WaitGroup
+
+	limiter        *rateLimiter
+	trustedProxies []netip.Prefix
+	loginFailures  *failureCounter
+	unknownEmails  *failureCounter
+
+	// migrationVersion is the latest migration in cfg.migrations, if set.
+	migrationVersion uint
+	// draining is set once shutdown starts, to fail readiness checks.
+	draining atomic.Bool
 }
 
 func main() {
@@ -44,59 +146,407 @@ func main() {
 		cfg        config
 		migrations = fs.String("migrations", "", "Path to migration files folder. If not provided, migrations do not applied")
 		port       = fs.Int("port", 8081, "API server port")
+		adminHost  = fs.String("admin-host", "127.0.0.1", "Address the admin server listens on. It has no authentication, so only widen this on a private network")
+		adminPort  = fs.Int("admin-port", 0, "Port of a separate admin server for /metrics and /log-level. If not provided, neither is served")
+		drainDelay = fs.Duration("drain-delay", 0, "Time between failing readiness checks and shutting down the server on SIGTERM, for load balancers to stop sending traffic")
 		env        = fs.String("env", "development", "Environment (development|staging|production)")
 		dbDsn      = fs.String("dsn", "postgresql://postgres:1@localhost:5432/data_go?sslmode=disable", "PostgreSQL DSN")
+
+		logLevel            = fs.String("log-level", "info", "Minimum log level (debug|info|warn|error|off)")
+		logSampleFirst      = fs.Int("log-sample-first", 0, "Entries with the same level and message logged each second before sampling starts. 0 disables sampling")
+		logSampleThereafter = fs.Int("log-sample-thereafter", 100, "Once sampling, log every Nth entry with the same level and message")
+
+		dbQueryTimeout   = fs.Duration("db-query-timeout", 3*time.Second, "Maximum duration of a database query")
+		dbMaxOpenConns   = fs.Int("db-max-open-conns", 25, "Maximum open database connections. 0 means no limit")
+		dbMaxIdleConns   = fs.Int("db-max-idle-conns", 25, "Maximum idle database connections")
+		dbMaxLifetime    = fs.Duration("db-max-lifetime", time.Hour, "Maximum time a database connection is reused. 0 means no limit")
+		dbMaxIdleTime    = fs.Duration("db-max-idle-time", 15*time.Minute, "Maximum time a database connection stays idle. 0 means no limit")
+		dbPingTimeout    = fs.Duration("db-ping-timeout", 5*time.Second, "Maximum duration of each database ping on startup")
+		dbConnectTimeout = fs.Duration("db-connect-timeout", 30*time.Second, "How long to keep retrying to reach the database on startup")
+
+		accessTokenTTL  = fs.Duration("access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+		refreshTokenTTL = fs.Duration("refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+		authMode        = fs.String("auth-mode", "token", "Access token format (token|jwt)")
+		jwtIssuer       = fs.String("jwt-issuer", "marvel-shop", "JWT issuer (iss)")
+		jwtAudience     = fs.String("jwt-audience", "marvel-shop-api", "JWT audience (aud)")
+		jwtKeys         = fs.String("jwt-keys", "", "Comma-separated JWT keys as kid:alg:base64-material, alg being HS256 or EdDSA")
+		jwtSigningKeyID = fs.String("jwt-signing-key", "", "ID of the key used to sign new JWTs. Defaults to the first key")
+
+		oidcIssuer       = fs.String("oidc-issuer", "", "OpenID Connect issuer URL. If not provided, OIDC login is disabled")
+		oidcClientID     = fs.String("oidc-client-id", "", "OpenID Connect client ID")
+		oidcClientSecret = fs.String("oidc-client-secret", "", "OpenID Connect client secret")
+		oidcRedirectURL  = fs.String("oidc-redirect-url", "http://localhost:8081/api/v1/oidc/callback", "OpenID Connect redirect URL")
+
+		passwordHasher      = fs.String("password-hasher", "bcrypt", "Hash algorithm for new passwords (bcrypt|argon2id)")
+		bcryptCost          = fs.Int("bcrypt-cost", 12, "bcrypt cost")
+		argon2Memory        = fs.Int("argon2-memory", 64*1024, "argon2id memory in KiB")
+		argon2Iterations    = fs.Int("argon2-iterations", 3, "argon2id iterations")
+		argon2Parallelism   = fs.Int("argon2-parallelism", 2, "argon2id parallelism")
+		passwordMinLength   = fs.Int("password-min-length", 8, "Minimum password length in bytes")
+		passwordMinScore    = fs.Int("password-min-score", 2, "Minimum password strength score, 0 (off) to 4")
+		breachedPasswordDir = fs.String("breached-passwords-dir", "", "Directory of k-anonymity SHA-1 range files of breached passwords. If not provided, passwords aren't checked")
+
+		limiterEnabled  = fs.Bool("limiter-enabled", true, "Enable request rate limiting")
+		limiterRPS      = fs.Float64("limiter-rps", 10, "Rate limiter maximum requests per second per client")
+		limiterBurst    = fs.Int("limiter-burst", 20, "Rate limiter maximum burst per client")
+		limiterRoutes   = fs.String("limiter-routes", "POST /api/v1/users/login=0.2:5,POST /api/v1/tokens/2fa=0.2:5,POST /api/v1/tokens/password-reset=0.05:3", "Comma-separated per-route limits as \"METHOD /path/template=rps:burst\"")
+		limiterStore    = fs.String("limiter-store", "memory", "Rate limiter store (memory|redis)")
+		limiterRedisURL = fs.String("limiter-redis-url", "redis://localhost:6379/0", "Redis URL for the redis rate limiter store")
+		trustedProxies  = fs.String("trusted-proxies", "", "Comma-separated IPs or CIDR ranges of proxies whose X-Forwarded-For header is trusted")
+
+		corsTrustedOrigins = fs.String("cors-trusted-origins", "", "Comma-separated origins allowed to make cross-origin requests, e.g. https://shop.example.com")
+
+		otlpEndpoint     = fs.String("otlp-endpoint", "", "OTLP/HTTP collector URL for traces, e.g. http://localhost:4318. If not provided, tracing is disabled")
+		traceSampleRatio = fs.Float64("trace-sample-ratio", 1, "Fraction of new traces recorded, 0 to 1")
+
+		smtpHost     = fs.String("smtp-host", "", "SMTP host. If not provided, emails are written to the log instead")
+		smtpPort     = fs.Int("smtp-port", 1025, "SMTP port")
+		smtpUsername = fs.String("smtp-username", "", "SMTP username")
+		smtpPassword = fs.String("smtp-password", "", "SMTP password")
+		smtpSender   = fs.String("smtp-sender", "Marvel Shop <no-reply@marvelshop.local>", "SMTP sender")
 	)
 
 	logger := jsonlog.NewLogger(os.Stdout, jsonlog.LevelInfo)
 
 	if err := ff.Parse(fs, os.Args[1:], ff.WithEnvVars()); err != nil {
-		logger.PrintFatal(err, nil)
+		logger.Fatal(err.Error())
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 	}
 
 	cfg.port = *port
+	cfg.adminHost = *adminHost
+	cfg.adminPort = *adminPort
+	cfg.drainDelay = *drainDelay
 	cfg.env = *env
+	cfg.log.level = *logLevel
+	cfg.log.sampleFirst = *logSampleFirst
+	cfg.log.sampleThereafter = *logSampleThereafter
 	cfg.db.dsn = *dbDsn
+	cfg.db.queryTimeout = *dbQueryTimeout
+	cfg.db.maxOpenConns = *dbMaxOpenConns
+	cfg.db.maxIdleConns = *dbMaxIdleConns
+	cfg.db.maxLifetime = *dbMaxLifetime
+	cfg.db.maxIdleTime = *dbMaxIdleTime
+	cfg.db.pingTimeout = *dbPingTimeout
+	cfg.db.connectTimeout = *dbConnectTimeout
 	cfg.migrations = *migrations
+	cfg.tokens.accessTTL = *accessTokenTTL
+	cfg.tokens.refreshTTL = *refreshTokenTTL
+	cfg.auth.mode = *authMode
+	cfg.jwt.issuer = *jwtIssuer
+	cfg.jwt.audience = *jwtAudience
+	cfg.jwt.signingKeyID = *jwtSigningKeyID
+	if *jwtKeys != "" {
+		cfg.jwt.keys = strings.Split(*jwtKeys, ",")
+	}
+	cfg.oidc.issuer = *oidcIssuer
+	cfg.oidc.clientID = *oidcClientID
+	cfg.oidc.clientSecret = *oidcClientSecret
+	cfg.oidc.redirectURL = *oidcRedirectURL
+	cfg.passwords.hasher = *passwordHasher
+	cfg.passwords.bcryptCost = *bcryptCost
+	cfg.passwords.argon2Memory = *argon2Memory
+	cfg.passwords.argon2Iterations = *argon2Iterations
+	cfg.passwords.argon2Parallelism = *argon2Parallelism
+	cfg.passwords.minLength = *passwordMinLength
+	cfg.passwords.minScore = *passwordMinScore
+	cfg.passwords.breachedDir = *breachedPasswordDir
+	cfg.limiter.enabled = *limiterEnabled
+	cfg.limiter.rps = *limiterRPS
+	cfg.limiter.burst = *limiterBurst
+	cfg.limiter.routes = *limiterRoutes
+	cfg.limiter.store = *limiterStore
+	cfg.limiter.redisURL = *limiterRedisURL
+	if *trustedProxies != "" {
+		cfg.trustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	for _, origin := range strings.Split(*corsTrustedOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, origin)
+		}
+	}
+	cfg.tracing.endpoint = *otlpEndpoint
+	cfg.tracing.sampleRatio = *traceSampleRatio
+	cfg.smtp.host = *smtpHost
+	cfg.smtp.port = *smtpPort
+	cfg.smtp.username = *smtpUsername
+	cfg.smtp.password = *smtpPassword
+	cfg.smtp.sender = *smtpSender
 
-	logger.PrintInfo("starting application with configuration", map[string]string{
-		"port":       fmt.Sprintf("%d", cfg.port),
-		"env":        cfg.env,
-		"db":         cfg.db.dsn,
-		"migrations": cfg.migrations,
-	})
+	logger.Info("starting application with configuration",
+		"port", cfg.port,
+		"env", cfg.env,
+		"db", cfg.db.dsn,
+		"migrations", cfg.migrations,
+		"smtp_host", cfg.smtp.host,
+		"auth_mode", cfg.auth.mode,
+		"hasher", cfg.passwords.hasher,
+		"limiter", cfg.limiter.store,
+		"tracing", cfg.tracing.endpoint,
+	)
+
+	level, err := jsonlog.ParseLevel(cfg.log.level)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	logger.SetLevel(level)
+	logger.SetSampling(time.Second, cfg.log.sampleFirst, cfg.log.sampleThereafter)
+	logger.SetContextFields(logContextFields)
+
+	if cfg.db.queryTimeout <= 0 {
+		logger.Fatal("db query timeout must be positive")
+	}
+	if cfg.db.maxOpenConns < 0 || cfg.db.maxIdleConns < 0 || cfg.db.maxLifetime < 0 || cfg.db.maxIdleTime < 0 {
+		logger.Fatal("db pool settings must not be negative")
+	}
+	if cfg.db.pingTimeout <= 0 {
+		logger.Fatal("db ping timeout must be positive")
+	}
+	// Without SMTP nobody could activate an account or reset a password.
+	if cfg.env == "production" && cfg.smtp.host == "" {
+		logger.Fatal("smtp host must be set in production")
+	}
 
-	db, err := openDB(cfg)
+	err = configurePasswords(cfg)
 	if err != nil {
-		logger.PrintError(err, nil)
+		logger.Fatal(err.Error())
+	}
+
+	db, err := openDB(cfg, logger)
+	if err != nil {
+		logger.Error(err.Error())
 		return
 	}
 
 	defer func() {
 		if err := db.Close(); err != nil {
-			logger.PrintFatal(err, nil)
+			logger.Fatal(err.Error())
 		}
 	}()
 
 	app := &application{
-		config: cfg,
-		models: model.NewModels(db),
-		logger: logger,
+		config:  cfg,
+		db:      db,
+		models:  model.NewModels(db, cfg.db.queryTimeout, slog.New(logger.Handler())),
+		logger:  logger,
+		metrics: newMetrics(db, logger),
+
+		loginFailures: newIPFailures(),
+		unknownEmails: newUnknownEmailFailures(),
+	}
+
+	if cfg.migrations != "" {
+		app.migrationVersion, err = latestMigration(cfg.migrations)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
+
+	app.limiter, err = newRateLimiter(cfg)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	app.trustedProxies, err = parseTrustedProxies(cfg.trustedProxies)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	switch cfg.auth.mode {
+	case "token":
+	case "jwt":
+		app.jwt, err = newJWTManager(cfg)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+	default:
+		logger.Fatal("invalid auth mode", "auth_mode", cfg.auth.mode)
+	}
+
+	if cfg.oidc.issuer != "" {
+		app.oidc = oidc.NewProvider(oidc.Config{
+			IssuerURL:    cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+		})
+	}
+
+	if cfg.smtp.host != "" {
+		app.mailer = mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+	} else {
+		app.mailer = logMailer{app: app}
+	}
+
+	// Incoming traceparent headers are honoured, so that log entries carry
+	// the caller's trace ID, even when this instance doesn't export spans.
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.tracing.endpoint != "" {
+		tracerProvider, err = newTracerProvider(cfg, logger)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		otel.SetTracerProvider(tracerProvider)
 	}
 
 	if err := app.serve(); err != nil {
-		logger.PrintFatal(err, nil)
+		logger.Fatal(err.Error())
+	}
+
+	app.loginFailures.Close()
+	app.unknownEmails.Close()
+
+	if closer, ok := app.limiter.store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error(err.Error())
+		}
 	}
+
+	if tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// newTracerProvider exports spans in batches over OTLP/HTTP to the
+// collector at the configured endpoint, such as "http://localhost:4318",
+// adding "/v1/traces" unless the path is already given. New traces are
+// sampled at the configured ratio; traces started by a caller keep the
+// caller's decision.
+func newTracerProvider(cfg config, logger *jsonlog.Logger) (*sdktrace.TracerProvider, error) {
+	if cfg.tracing.sampleRatio < 0 || cfg.tracing.sampleRatio > 1 {
+		return nil, errors.New("trace sample ratio must be between 0 and 1")
+	}
+
+	endpoint := strings.TrimSuffix(cfg.tracing.endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error(err.Error())
+	}))
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.tracing.sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "marvel-shop-api"),
+			attribute.String("service.version", version),
+			attribute.String("deployment.environment", cfg.env),
+		)),
+	), nil
+}
+
+func newJWTManager(cfg config) (*jwt.Manager, error) {
+	var keys []jwt.Key
+
+	for _, spec := range cfg.jwt.keys {
+		key, err := jwt.ParseKey(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewManager(keys, cfg.jwt.signingKeyID, cfg.jwt.issuer, cfg.jwt.audience)
+}
+
+func newRateLimiter(cfg config) (*rateLimiter, error) {
+	limiter := &rateLimiter{
+		enabled: cfg.limiter.enabled,
+		limit:   ratelimit.Limit{Rate: cfg.limiter.rps, Burst: cfg.limiter.burst},
+	}
+
+	if cfg.limiter.rps <= 0 || cfg.limiter.burst < 1 {
+		return nil, errors.New("limiter rps and burst must be positive")
+	}
+
+	routes, err := parseRouteLimits(cfg.limiter.routes)
+	if err != nil {
+		return nil, err
+	}
+	limiter.routes = routes
+
+	switch cfg.limiter.store {
+	case "memory":
+		limiter.store = ratelimit.NewMemoryStore()
+	case "redis":
+		store, err := ratelimit.NewRedisStore(cfg.limiter.redisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := store.Ping(ctx); err != nil {
+			return nil, err
+		}
+		limiter.store = store
+	default:
+		return nil, fmt.Errorf("invalid limiter store %q", cfg.limiter.store)
+	}
+
+	return limiter, nil
+}
+
+func configurePasswords(cfg config) error {
+	switch cfg.passwords.hasher {
+	case "bcrypt":
+		if cfg.passwords.bcryptCost < bcrypt.MinCost || cfg.passwords.bcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		model.SetPasswordHasher(model.BcryptHasher{Cost: cfg.passwords.bcryptCost})
+	case "argon2id":
+		if cfg.passwords.argon2Memory < 1 || cfg.passwords.argon2Iterations < 1 ||
+			cfg.passwords.argon2Parallelism < 1 || cfg.passwords.argon2Parallelism > 255 {
+			return errors.New("invalid argon2id parameters")
+		}
+		model.SetPasswordHasher(model.Argon2idHasher{
+			Memory:      uint32(cfg.passwords.argon2Memory),
+			Iterations:  uint32(cfg.passwords.argon2Iterations),
+			Parallelism: uint8(cfg.passwords.argon2Parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		})
+	default:
+		return fmt.Errorf("invalid password hasher %q", cfg.passwords.hasher)
+	}
+
+	return model.SetPasswordPolicy(model.PasswordPolicy{
+		MinLength:   cfg.passwords.minLength,
+		MinScore:    cfg.passwords.minScore,
+		BreachedDir: cfg.passwords.breachedDir,
+	})
 }
 
-func openDB(cfg config) (*sql.DB, error) {
+func openDB(cfg config, logger *jsonlog.Logger) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.db.maxLifetime)
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+
+	err = waitForDB(db, cfg, logger)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -116,3 +566,60 @@ func openDB(cfg config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// waitForDB pings the database until it answers, backing off between
+// attempts, for at most cfg.db.connectTimeout. The API may well start before
+// the database when both run in containers.
+func waitForDB(db *sql.DB, cfg config, logger *jsonlog.Logger) error {
+	deadline := time.Now().Add(cfg.db.connectTimeout)
+	backoff := 500 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.db.pingTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+
+		wait := min(backoff, remaining)
+		logger.Warn("database unreachable, retrying", "attempt", attempt, "retry_in", wait, "error", err)
+
+		time.Sleep(wait)
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// latestMigration returns the version of the last migration in the given
+// source.
+func latestMigration(sourceURL string) (uint, error) {
+	src, err := source.Open(sourceURL)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	version, err := src.First()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/godra-y/go-project/pkg/jsonlog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewTracerProviderSampleRatio(t *testing.T) {
+	tests := []struct {
+		ratio   float64
+		wantErr bool
+	}{
+		{0, false},
+		{0.25, false},
+		{1, false},
+		{-0.1, true},
+		{1.5, true},
+	}
+
+	for _, tt := range tests {
+		var cfg config
+		cfg.tracing.endpoint = "http://localhost:4318"
+		cfg.tracing.sampleRatio = tt.ratio
+
+		tp, err := newTracerProvider(cfg, jsonlog.NewLogger(io.Discard, jsonlog.LevelOff))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ratio %v: got error %v; want error %t", tt.ratio, err, tt.wantErr)
+		}
+		if tp != nil {
+			tp.Shutdown(context.Background())
+		}
+	}
+}
+
+// TestTracingCollector sends a traced request through the middleware and
+// checks what a collector receives.
+func TestTracingCollector(t *testing.T) {
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 10)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("got %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- &req
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	var cfg config
+	cfg.env = "test"
+	cfg.tracing.endpoint = collector.URL
+	cfg.tracing.sampleRatio = 1
+
+	tp, err := newTracerProvider(cfg, jsonlog.NewLogger(io.Discard, jsonlog.LevelOff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	app := &application{}
+	handler := app.traceRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeJSON(w, r, http.StatusOK, envelope{"status": "available"}, nil)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Shutting down flushes the batch.
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(received)
+
+	spans := map[string]*tracepb.Span{}
+	for req := range received {
+		for _, rs := range req.ResourceSpans {
+			if got := resourceAttribute(rs, "service.name"); got != "marvel-shop-api" {
+				t.Errorf("got service.name %q", got)
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+	}
+
+	server, ok := spans["HTTP GET"]
+	if !ok {
+		t.Fatalf("no request span among %d spans", len(spans))
+	}
+	if got := hex.EncodeToString(server.TraceId); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span in trace %s; want the caller's", got)
+	}
+	if got := hex.EncodeToString(server.ParentSpanId); got != "00f067aa0ba902b7" {
+		t.Errorf("request span has parent %s; want the caller's span", got)
+	}
+	if server.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("got kind %v", server.Kind)
+	}
+
+	encode, ok := spans["writeJSON"]
+	if !ok {
+		t.Fatal("no writeJSON span")
+	}
+	if string(encode.ParentSpanId) != string(server.SpanId) {
+		t.Error("writeJSON span isn't a child of the request span")
+	}
+}
+
+func resourceAttribute(rs *tracepb.ResourceSpans, key string) string {
+	for _, kv := range rs.Resource.GetAttributes() {
+		if kv.Key == key {
+			return kv.Value.GetStringValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/godra-y/go-project/pkg/oidc"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// JWT access tokens aren't stored, so in that mode each session is
+	// represented by its refresh token instead.
+	scope := model.ScopeAuthentication
+	if app.jwt != nil {
+		scope = model.ScopeRefresh
+	}
+
+	sessions, err := app.models.Tokens.GetAllForUser(r.Context(), scope, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	hash, family := app.contextGetTokenHash(r), app.contextGetTokenFamily(r)
+	for _, session := range sessions {
+		session.Current = bytes.Equal(session.Hash, hash) || (family != nil && bytes.Equal(session.Family, family))
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+const emailChangeTokenTTL = 24 * time.Hour
+
+// currentUser reloads the authenticated user from the database, for
+// handlers that change it, since another request may have changed or
+// closed the account since authenticate() loaded it. A user that no longer
+// exists gets the same response as a revoked token. It sends the error
+// response itself and returns false if the handler should stop.
+func (app *application) currentUser(w http.ResponseWriter, r *http.Request) (*model.User, bool) {
+	user, err := app.models.User.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// confirmPassword checks a password re-entered to authorise a sensitive
+// change. Wrong guesses count against the client's IP like failed logins, so
+// a stolen session can't be used to brute force the password. It sends the
+// error response itself and returns false if the change should not go ahead.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *model.User, field, plaintext string) bool {
+	ip := app.clientIP(r)
+
+	if wait := app.loginFailures.Blocked(ip); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return false
+	}
+
+	match, err := user.Password.Matches(plaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		app.loginFailures.Fail(ip)
+		app.failedValidationResponse(w, r, map[string][]string{field: {"is incorrect"}})
+		return false
+	}
+
+	return true
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name *string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if model.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	model.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, "current_password", input.CurrentPassword) {
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The rest of the policy needs the user, to check the password doesn't
+	// contain their name or email.
+	if model.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The session making the change stays signed in; every other one has to
+	// sign in again with the new password.
+	err = app.models.Tokens.DeleteOtherSessions(r.Context(), user.ID, app.contextGetTokenHash(r), app.contextGetTokenFamily(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "your password was successfully changed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	model.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, "password", input.Password) {
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from your current email address")
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	_, err = app.models.User.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	case !errors.Is(err, model.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.EmailChange.Set(r.Context(), user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the token sent for the latest request should work.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, emailChangeTokenTTL, model.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(r, user.ID, input.Email, "token_email_change", map[string]interface{}{
+		"emailChangeToken": token.Plaintext,
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing instructions to confirm it"}
+
+	err = app.writeJSON(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	user, ok := app.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, "password", input.Password) {
+		return
+	}
+
+	err = app.closeAccount(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.requestLogger(r).Info("user account closed", "user_id", user.ID)
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "your account was successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// closeAccount anonymises a user's account, see UserModel.Anonymize. Nobody
+// should be able to sign in to a closed account, so its password becomes a
+// random value that is never shown to anyone.
+func (app *application) closeAccount(ctx context.Context, user *model.User) error {
+	password, err := oidc.RandomString(24)
+	if err != nil {
+		return err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	return app.models.User.Anonymize(ctx, user)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/jsonlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the application's own counters, and the registry they are
+// exposed through on /metrics.
+type metrics struct {
+	registry *prometheus.Registry
+
+	// panics counts panics recovered from handlers and background tasks.
+	panics atomic.Int64
+
+	// background counts running background tasks. It mirrors app.wg, whose
+	// count can't be read.
+	background atomic.Int64
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+}
+
+func newMetrics(db *sql.DB, logger *jsonlog.Logger) *metrics {
+	m := &metrics{registry: prometheus.NewRegistry()}
+
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by method, route template and status.",
+	}, []string{"method", "route", "status"})
+	m.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by method, route template and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	m.inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests being handled.",
+	})
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inFlight,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "app_panics_total",
+			Help: "Panics recovered from handlers and background tasks.",
+		}, func() float64 { return float64(m.panics.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "app_background_tasks",
+			Help: "Background tasks running.",
+		}, func() float64 { return float64(m.background.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "app_build_info",
+			Help:        "Build information, always 1.",
+			ConstLabels: prometheus.Labels{"version": version, "goversion": runtime.Version()},
+		}, func() float64 { return 1 }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if logger != nil {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "log_sampled_dropped_total",
+			Help: "Log entries dropped by sampling.",
+		}, func() float64 { return float64(logger.Dropped()) }))
+	}
+
+	// The connection pool statistics are exported as go_sql_*.
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+	}
+
+	return m
+}
+
+// handler serves the registry in the Prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeRequest records a finished request. Requests that matched no
+// route, and unusual methods, are grouped so that clients can't create new
+// series at will.
+func (m *metrics) observeRequest(method, route string, status int, duration time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER"
+	}
+
+	if route == "" {
+		route = "unmatched"
+	}
+
+	code := strconv.Itoa(status)
+
+	m.requests.WithLabelValues(method, route, code).Inc()
+	m.duration.WithLabelValues(method, route, code).Observe(duration.Seconds())
+}
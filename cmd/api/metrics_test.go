@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		route  string
+		status int
+		labels []string
+	}{
+		{"matched route", http.MethodGet, "/api/v1/products/{id}", 200, []string{"GET", "/api/v1/products/{id}", "200"}},
+		{"unmatched route", http.MethodGet, "", 404, []string{"GET", "unmatched", "404"}},
+		{"unusual method", "PROPFIND", "/api/v1/products", 405, []string{"OTHER", "/api/v1/products", "405"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMetrics(nil, nil)
+
+			m.observeRequest(tt.method, tt.route, tt.status, 150*time.Millisecond)
+			m.observeRequest(tt.method, tt.route, tt.status, 150*time.Millisecond)
+
+			if got := testutil.ToFloat64(m.requests.WithLabelValues(tt.labels...)); got != 2 {
+				t.Errorf("got %v requests; want 2", got)
+			}
+			if got := testutil.CollectAndCount(m.duration); got != 1 {
+				t.Errorf("got %d duration series; want 1", got)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetrics(nil, nil)
+	m.panics.Add(3)
+	m.observeRequest(http.MethodGet, "/v1/healthcheck", 200, time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	m.handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d", rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"app_panics_total 3",
+		`http_requests_total{method="GET",route="/v1/healthcheck",status="200"} 1`,
+		"http_request_duration_seconds_bucket",
+		"app_build_info{",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
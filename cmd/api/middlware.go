@@ -1,26 +1,303 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/godra-y/go-project/pkg/api/model"
 	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
+	"runtime/debug"
 	"strings"
+	"time"
 )
 
+// responseRecorder remembers the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// logRequest writes an access log entry for every request once it has been
+// handled, and records it in the request metrics.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		app.metrics.inFlight.Inc()
+		defer app.metrics.inFlight.Dec()
+
+		info := &requestInfo{}
+		r = app.contextSetRequestInfo(r, info)
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, r)
+
+		duration := time.Since(start)
+		app.metrics.observeRequest(r.Method, info.route, rw.status, duration)
+
+		args := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", info.route,
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration_ms", float64(duration.Microseconds()) / 1000,
+			"remote_addr", app.clientIP(r),
+		}
+
+		if info.userID != 0 {
+			args = append(args, "user_id", info.userID)
+		}
+
+		app.requestLogger(r).Info("request", args...)
+	})
+}
+
+// matchRoute records the template of the route the request matches, and
+// renames the request's span after it. It runs before authentication, so
+// requests rejected there are still counted under their route.
+func (app *application) matchRoute(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			match    mux.RouteMatch
+			template string
+		)
+		if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+			template, _ = match.Route.GetPathTemplate()
+		}
+
+		if info := app.contextGetRequestInfo(r); info != nil {
+			info.route = template
+		}
+
+		if span := trace.SpanFromContext(r.Context()); span.IsRecording() && template != "" {
+			span.SetName(r.Method + " " + template)
+			span.SetAttributes(attribute.String("http.route", template))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordUser is router middleware that records the authenticated user in the
+// request details and on the request's span.
+func (app *application) recordUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userContextKey).(*model.User)
+		if ok && !user.IsAnonymous() {
+			if info := app.contextGetRequestInfo(r); info != nil {
+				info.userID = user.ID
+			}
+			if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+				span.SetAttributes(attribute.Int64("enduser.id", user.ID))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+var tracer = otel.Tracer("github.com/godra-y/go-project/cmd/api")
+
+// traceRequest starts a server span for every request, continuing the
+// caller's trace when the request has a traceparent header.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", app.clientIP(r)),
+				attribute.String("user_agent.original", r.UserAgent()),
+				attribute.String("request_id", app.contextGetRequestID(r)),
+			),
+		)
+		defer span.End()
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rw.status))
+		if rw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	})
+}
+
+// recoverPanic turns a panic in a handler into a 500 response, rather than
+// the connection being dropped. The error is logged with the stack trace, and
+// the connection is closed after the response since the handler may have left
+// it in an unknown state.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				// ErrAbortHandler is how a handler deliberately aborts a
+				// response, and the server already handles it quietly.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				app.metrics.panics.Add(1)
+
+				trace.SpanFromContext(r.Context()).RecordError(fmt.Errorf("panic: %v", err))
+				app.requestLogger(r).Error(fmt.Sprintf("panic: %v", err),
+					"request_method", r.Method,
+					"request_url", r.URL.String(),
+					"stack", string(debug.Stack()),
+				)
+
+				w.Header().Set("Connection", "close")
+				message := "the server encountered a problem and could not process your request"
+				app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID propagates the client's X-Request-ID header, or generates a new
+// ID if there isn't a valid one, and stores it in the request context.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether a client's request ID is safe to log and
+// echo back: at most 128 letters, digits, dots, underscores and hyphens.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// enableCORS lets browsers on the trusted origins call the API, with
+// credentials. Preflight requests are answered here, before they reach
+// authentication or the router.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+
+		if origin != "" && app.trustedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-API-Key, X-Request-ID")
+				w.Header().Set("Access-Control-Max-Age", "600")
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) trustedOrigin(origin string) bool {
+	for _, trusted := range app.config.cors.trustedOrigins {
+		if origin == trusted {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Vary", "Authorization")
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		authorizationHeader := r.Header.Get("Authorization")
+		apiKeyHeader := r.Header.Get("X-API-Key")
 
-		if authorizationHeader == "" {
+		if authorizationHeader == "" && apiKeyHeader == "" {
 			r = app.contextSetUser(r, model.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if apiKeyHeader != "" {
+			app.authenticateAPIKey(w, r, next, apiKeyHeader)
+			return
+		}
+
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -28,6 +305,40 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		// JWTs are verified locally, then checked against their session, so
+		// that signing out or deactivation takes effect before they expire.
+		// Opaque tokens never contain a dot, so clients holding one still go
+		// through the token lookup below.
+		if app.jwt != nil && strings.Count(token, ".") == 2 {
+			userID, family, err := app.verifyJWT(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			user, err := app.models.User.GetForSession(r.Context(), userID, family)
+			if err != nil {
+				switch {
+				case errors.Is(err, model.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if user.Deactivated {
+				app.deactivatedAccountResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetTokenFamily(r, family)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 
 		if model.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -35,23 +346,121 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.User.GetForToken(model.ScopeAuthentication, token)
+		user, err := app.models.User.GetForToken(r.Context(), model.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, model.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				app.authenticateImpersonation(w, r, next, token)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
 
+		if user.Deactivated {
+			app.deactivatedAccountResponse(w, r)
+			return
+		}
+
+		hash := model.HashToken(token)
+
+		err = app.models.Tokens.Touch(r.Context(), hash)
+		if err != nil {
+			app.logError(r, err)
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetTokenHash(r, hash)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, keyPlaintext string) {
+	v := validator.New()
+
+	if model.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	user, key, err := app.models.APIKeys.GetForKey(r.Context(), keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Touch(r.Context(), key.ID)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// authenticateImpersonation handles bearer tokens that aren't ordinary
+// authentication tokens, which leaves impersonation tokens issued to support
+// staff. Every request made with one is logged with both users' IDs.
+func (app *application) authenticateImpersonation(w http.ResponseWriter, r *http.Request, next http.Handler, tokenPlaintext string) {
+	token, err := app.models.Tokens.Get(r.Context(), model.ScopeImpersonation, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.Touch(r.Context(), token.Hash)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetTokenHash(r, token.Hash)
+	r = app.contextSetImpersonator(r, *token.ImpersonatorID)
+
+	app.requestLogger(r).Info("impersonated request",
+		"impersonator_id", *token.ImpersonatorID,
+		"user_id", user.ID,
+		"request_method", r.Method,
+		"request_url", r.URL.String(),
+	)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -80,11 +489,27 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireInteractiveUser rejects requests made with an API key or an
+// impersonation token, for endpoints such as managing API keys that only the
+// user themselves should reach.
+func (app *application) requireInteractiveUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil || app.contextGetImpersonator(r) != 0 {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -95,6 +520,12 @@ func (app *application) requirePermissions(code string, next http.HandlerFunc) h
 			return
 		}
 
+		// API keys are further limited to the permissions granted to the key.
+		if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/godra-y/go-project/pkg/jsonlog"
+	"github.com/gorilla/mux"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"4f0c2b9e.retry_2", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"with space", false},
+		{"line\nbreak", false},
+		{"quote\"", false},
+		{"<script>", false},
+		{"café", false},
+	}
+
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %t; want %t", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"none", "", false},
+		{"valid", "req-42", true},
+		{"unsafe", "req 42\r\nX-Injected: 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := app.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = app.contextGetRequestID(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			got := w.Header().Get("X-Request-ID")
+			if got != seen {
+				t.Errorf("response has ID %q but the context has %q", got, seen)
+			}
+			if tt.keep && got != tt.header {
+				t.Errorf("got ID %q; want the client's %q", got, tt.header)
+			}
+			if !tt.keep && (got == tt.header || !validRequestID(got)) {
+				t.Errorf("got ID %q; want a generated one", got)
+			}
+		})
+	}
+}
+
+func TestEnableCORS(t *testing.T) {
+	app := &application{}
+	app.config.cors.trustedOrigins = []string{"https://shop.example.com"}
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantOrigin  string
+		wantMethods bool
+		wantStatus  int
+		wantNext    bool
+	}{
+		{"no origin", http.MethodGet, "", false, "", false, http.StatusOK, true},
+		{"trusted origin", http.MethodGet, "https://shop.example.com", false, "https://shop.example.com", false, http.StatusOK, true},
+		{"untrusted origin", http.MethodGet, "https://evil.example.com", false, "", false, http.StatusOK, true},
+		{"preflight", http.MethodOptions, "https://shop.example.com", true, "https://shop.example.com", true, http.StatusNoContent, false},
+		{"untrusted preflight", http.MethodOptions, "https://evil.example.com", true, "", false, http.StatusOK, true},
+		{"plain OPTIONS", http.MethodOptions, "https://shop.example.com", false, "https://shop.example.com", false, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			handler := app.enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+
+			r := httptest.NewRequest(tt.method, "/v1/products", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			// Caches must key on the headers the response depends on, even
+			// when no CORS headers are sent.
+			vary := w.Header().Values("Vary")
+			if len(vary) != 2 || vary[0] != "Origin" || vary[1] != "Access-Control-Request-Method" {
+				t.Errorf("got Vary %q", vary)
+			}
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q; want %q", got, tt.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods") != ""; got != tt.wantMethods {
+				t.Errorf("got Access-Control-Allow-Methods %t; want %t", got, tt.wantMethods)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantStatus)
+			}
+			if called != tt.wantNext {
+				t.Errorf("next handler called %t; want %t", called, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var logs bytes.Buffer
+	app := &application{
+		logger:  jsonlog.NewLogger(&logs, jsonlog.LevelInfo),
+		metrics: newMetrics(nil, nil),
+	}
+
+	handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something broke")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/products", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if got := w.Header().Get("Connection"); got != "close" {
+		t.Errorf("got Connection %q; want close", got)
+	}
+	if strings.Contains(w.Body.String(), "something broke") {
+		t.Errorf("panic value leaked to the client: %s", w.Body)
+	}
+	if got := app.metrics.panics.Load(); got != 1 {
+		t.Errorf("got %d panics counted; want 1", got)
+	}
+	if !strings.Contains(logs.String(), "panic: something broke") || !strings.Contains(logs.String(), "stack") {
+		t.Errorf("got log %s", logs.String())
+	}
+}
+
+// TestRecoverPanicAbort checks that http.ErrAbortHandler is passed on to the
+// server rather than turned into an error response.
+func TestRecoverPanicAbort(t *testing.T) {
+	app := &application{
+		logger:  jsonlog.NewLogger(&bytes.Buffer{}, jsonlog.LevelInfo),
+		metrics: newMetrics(nil, nil),
+	}
+
+	handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("got panic %v; want http.ErrAbortHandler", err)
+		}
+		if got := app.metrics.panics.Load(); got != 0 {
+			t.Errorf("got %d panics counted; want 0", got)
+		}
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/products", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMatchRoute(t *testing.T) {
+	app := &application{}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/products/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{"matched", http.MethodGet, "/api/v1/products/42", "/api/v1/products/{id}"},
+		{"not found", http.MethodGet, "/api/v1/nothing", ""},
+		{"method not allowed", http.MethodPost, "/api/v1/products/42", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The handler stands in for authenticate refusing the request
+			// before the router runs.
+			handler := app.matchRoute(router, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+
+			info := &requestInfo{}
+			r := app.contextSetRequestInfo(httptest.NewRequest(tt.method, tt.path, nil), info)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if info.route != tt.want {
+				t.Errorf("got route %q; want %q", info.route, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsNotPublic(t *testing.T) {
+	app := &application{
+		logger:  jsonlog.NewLogger(&bytes.Buffer{}, jsonlog.LevelInfo),
+		metrics: newMetrics(nil, nil),
+	}
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d on the API port; want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = httptest.NewRecorder()
+	app.adminRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d on the admin port; want %d", w.Code, http.StatusOK)
+	}
+}
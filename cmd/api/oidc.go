@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/godra-y/go-project/pkg/oidc"
+)
+
+const (
+	oidcLoginTTL    = 10 * time.Minute
+	oidcLoginCookie = "oidc_login"
+)
+
+// oidcLoginHandler sends the browser to the identity provider. The state,
+// nonce and PKCE verifier of the login are kept in an HttpOnly cookie
+// rather than on the server, which ties the callback to the browser that
+// started the login, so an attacker can't have a victim complete a login
+// into the attacker's account, and works whichever instance serves it.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := oidc.RandomString(16)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := oidc.RandomString(16)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The values are base64url encoded, so never contain a dot.
+	http.SetCookie(w, app.oidcCookie(strings.Join([]string{state, nonce, verifier}, "."), oidcLoginTTL))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCookie returns the login cookie, scoped to the callback. It is
+// SameSite=Lax rather than Strict, since the provider's redirect back is a
+// cross-site navigation, and Secure whenever the callback is served over
+// HTTPS. A zero maxAge deletes it.
+func (app *application) oidcCookie(value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+
+	if u, err := url.Parse(app.config.oidc.redirectURL); err == nil {
+		if u.Path != "" {
+			cookie.Path = u.Path
+		}
+		cookie.Secure = u.Scheme == "https"
+	}
+
+	return cookie
+}
+
+// oidcLoginFromCookie returns the nonce and PKCE verifier of the login that
+// state belongs to, if this browser started it.
+func oidcLoginFromCookie(r *http.Request, state string) (nonce, verifier string, ok bool) {
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || state == "" {
+		return "", "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	// Each login can only be completed once, whatever the outcome.
+	http.SetCookie(w, app.oidcCookie("", 0))
+
+	if e := qs.Get("error"); e != "" {
+		app.badRequestResponse(w, r, fmt.Errorf("identity provider returned an error: %s", e))
+		return
+	}
+
+	nonce, verifier, ok := oidcLoginFromCookie(r, qs.Get("state"))
+	if !ok {
+		app.badRequestResponse(w, r, errors.New("invalid or expired login state"))
+		return
+	}
+
+	code := qs.Get("code")
+	if code == "" {
+		app.badRequestResponse(w, r, errors.New("missing authorization code"))
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), code, verifier, nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logError(r, err)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForOIDCClaims(r.Context(), claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			app.unverifiedEmailResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The provider vouches for the password, not for the rest of the
+	// login, so a locked account stays locked and a second factor is
+	// still needed.
+	lockout, err := app.models.Lockouts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked, wait := lockout.Locked(); locked {
+		app.accountLockedResponse(w, r, wait)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+var errUnverifiedEmail = errors.New("identity provider has not verified the email address")
+
+// userForOIDCClaims returns the user linked to the provider account. The
+// first time an account is seen it is linked to the user with the same
+// verified email, or a new activated user is created for it.
+func (app *application) userForOIDCClaims(ctx context.Context, claims *oidc.Claims) (*model.User, error) {
+	user, err := app.models.Identities.GetUser(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, model.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, errUnverifiedEmail
+	}
+
+	user, err = app.models.User.GetByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		// The provider has confirmed the address, which is all activation
+		// would have done.
+		if !user.Activated {
+			user.Activated = true
+			if err = app.models.User.Update(ctx, user); err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, model.ErrRecordNotFound):
+		user, err = app.provisionOIDCUser(ctx, claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(ctx, claims.Issuer, claims.Subject, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (app *application) provisionOIDCUser(ctx context.Context, claims *oidc.Claims) (*model.User, error) {
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+
+	user := &model.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	// The user signs in through the provider, so the local password is just
+	// a random value nobody knows. A password reset can set a real one.
+	password, err := oidc.RandomString(24)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+
+	if model.ValidateUser(v, user); !v.Valid() {
+		return nil, fmt.Errorf("identity provider returned an invalid user: %v", v.Errors)
+	}
+
+	err = app.models.User.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
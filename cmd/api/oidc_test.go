@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOIDCCookie(t *testing.T) {
+	app := &application{}
+	app.config.oidc.redirectURL = "https://shop.example.com/api/v1/oidc/callback"
+
+	c := app.oidcCookie("value", oidcLoginTTL)
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got HttpOnly %t, Secure %t, SameSite %v", c.HttpOnly, c.Secure, c.SameSite)
+	}
+	if c.Path != "/api/v1/oidc/callback" || c.MaxAge != 600 {
+		t.Errorf("got path %q, max age %d", c.Path, c.MaxAge)
+	}
+
+	if c := app.oidcCookie("", 0); c.MaxAge >= 0 {
+		t.Errorf("got max age %d for a deleted cookie", c.MaxAge)
+	}
+
+	app.config.oidc.redirectURL = "http://localhost:4000/api/v1/oidc/callback"
+	if c := app.oidcCookie("value", oidcLoginTTL); c.Secure {
+		t.Error("got a Secure cookie for a plain HTTP callback")
+	}
+}
+
+func TestOIDCLoginFromCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		state  string
+		ok     bool
+	}{
+		{"matching state", "state1.nonce1.verifier1", "state1", true},
+		{"other state", "state1.nonce1.verifier1", "state2", false},
+		{"no cookie", "", "state1", false},
+		{"no state", "state1.nonce1.verifier1", "", false},
+		{"empty cookie state", ".nonce1.verifier1", "", false},
+		{"malformed", "state1.nonce1", "state1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/oidc/callback", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcLoginCookie, Value: tt.cookie})
+			}
+
+			nonce, verifier, ok := oidcLoginFromCookie(r, tt.state)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t; want %t", ok, tt.ok)
+			}
+			if ok && (nonce != "nonce1" || verifier != "verifier1") {
+				t.Errorf("got nonce %q, verifier %q", nonce, verifier)
+			}
+		})
+	}
+}
+
+// TestOIDCCallbackWithoutCookie checks that a callback from a browser that
+// didn't start the login is refused before the code is exchanged.
+func TestOIDCCallbackWithoutCookie(t *testing.T) {
+	app := &application{}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/oidc/callback?state=abc&code=attackers-code", nil)
+	w := httptest.NewRecorder()
+	app.oidcCallbackHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// The login cookie is cleared whatever the outcome.
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcLoginCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("got cookies %v; want the login cookie deleted", cookies)
+	}
+}
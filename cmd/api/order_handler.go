@@ -17,7 +17,7 @@ func (app *application) createOrderHandler(w http.ResponseWriter, r *http.Reques
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		log.Println(err)
-		app.errorResponse(w, r, http.StatusBadRequest, "Invalid request payload")
+		app.errorResponse(w, r, http.StatusBadRequest, "bad_request", "Invalid request payload")
 		return
 	}
 
@@ -26,13 +26,22 @@ func (app *application) createOrderHandler(w http.ResponseWriter, r *http.Reques
 		Quantity:  input.Quantity,
 	}
 
-	err = app.models.Order.Insert(order)
+	err = app.models.Order.Insert(r.Context(), order)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"order": order}, nil)
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		app.sendEmail(r, user.ID, user.Email, "order_confirmation", map[string]interface{}{
+			"name":      user.Name,
+			"orderID":   order.ID,
+			"productID": order.ProductID,
+			"quantity":  order.Quantity,
+		})
+	}
+
+	app.writeJSON(w, r, http.StatusCreated, envelope{"order": order}, nil)
 }
 
 func (app *application) getOrdersList(w http.ResponseWriter, r *http.Request) {
@@ -58,17 +67,17 @@ func (app *application) getOrdersList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	orders, metadata, err := app.models.Order.GetAll(input.Filters)
+	orders, metadata, err := app.models.Order.GetAll(r.Context(), input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
 }
 
 func (app *application) getOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -78,7 +87,7 @@ func (app *application) getOrderHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	order, err := app.models.Order.Get(id)
+	order, err := app.models.Order.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -89,7 +98,7 @@ func (app *application) getOrderHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"order": order}, nil)
 }
 
 func (app *application) getOrdersByProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -115,17 +124,17 @@ func (app *application) getOrdersByProductHandler(w http.ResponseWriter, r *http
 	}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	orders, metadata, err := app.models.Order.GetOrdersByProduct(productID, input.Filters)
+	orders, metadata, err := app.models.Order.GetOrdersByProduct(r.Context(), productID, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
 }
 
 func (app *application) updateOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -135,7 +144,7 @@ func (app *application) updateOrderHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	order, err := app.models.Order.Get(id)
+	order, err := app.models.Order.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -168,11 +177,11 @@ func (app *application) updateOrderHandler(w http.ResponseWriter, r *http.Reques
 	v := validator.New()
 
 	if model.ValidateOrder(v, order); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	err = app.models.Order.Update(order)
+	err = app.models.Order.Update(r.Context(), order)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -183,7 +192,7 @@ func (app *application) updateOrderHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"order": order}, nil)
 }
 
 func (app *application) deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -193,7 +202,7 @@ func (app *application) deleteOrderHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Order.Delete(id)
+	err = app.models.Order.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -204,5 +213,5 @@ func (app *application) deleteOrderHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
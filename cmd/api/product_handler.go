@@ -19,7 +19,7 @@ func (app *application) createProductHandler(w http.ResponseWriter, r *http.Requ
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		log.Println(err)
-		app.errorResponse(w, r, http.StatusBadRequest, "Invalid request payload")
+		app.errorResponse(w, r, http.StatusBadRequest, "bad_request", "Invalid request payload")
 		return
 	}
 
@@ -30,13 +30,13 @@ func (app *application) createProductHandler(w http.ResponseWriter, r *http.Requ
 		CategoryID:  input.CategoryID,
 	}
 
-	err = app.models.Product.Insert(product)
+	err = app.models.Product.Insert(r.Context(), product)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusCreated, envelope{"product": product}, nil)
+	app.writeJSON(w, r, http.StatusCreated, envelope{"product": product}, nil)
 }
 
 func (app *application) getProductsList(w http.ResponseWriter, r *http.Request) {
@@ -63,17 +63,17 @@ func (app *application) getProductsList(w http.ResponseWriter, r *http.Request)
 	}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	products, metadata, err := app.models.Product.GetAll(input.Title, input.Price, input.CategoryId, input.Filters)
+	products, metadata, err := app.models.Product.GetAll(r.Context(), input.Title, input.Price, input.CategoryId, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"products": products, "metadata": metadata}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"products": products, "metadata": metadata}, nil)
 }
 
 func (app *application) getProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +83,7 @@ func (app *application) getProductHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	product, err := app.models.Product.Get(id)
+	product, err := app.models.Product.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -94,7 +94,7 @@ func (app *application) getProductHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"product": product}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"product": product}, nil)
 }
 
 func (app *application) getProductsByCategoryHandler(w http.ResponseWriter, r *http.Request) {
@@ -124,17 +124,17 @@ func (app *application) getProductsByCategoryHandler(w http.ResponseWriter, r *h
 	}
 
 	if model.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	products, metadata, err := app.models.Product.GetProductsByCategory(categoryID, input.Title, input.Filters)
+	products, metadata, err := app.models.Product.GetProductsByCategory(r.Context(), categoryID, input.Title, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"products": products, "metadata": metadata}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"products": products, "metadata": metadata}, nil)
 }
 
 func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,7 +144,7 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	product, err := app.models.Product.Get(id)
+	product, err := app.models.Product.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -187,11 +187,11 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 	v := validator.New()
 
 	if model.ValidateProduct(v, product); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	err = app.models.Product.Update(product)
+	err = app.models.Product.Update(r.Context(), product)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -202,7 +202,7 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"product": product}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"product": product}, nil)
 }
 
 func (app *application) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -212,7 +212,7 @@ func (app *application) deleteProductHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.models.Product.Delete(id)
+	err = app.models.Product.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
@@ -223,5 +223,5 @@ func (app *application) deleteProductHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"message": "success"}, nil)
+	app.writeJSON(w, r, http.StatusOK, envelope{"message": "success"}, nil)
 }
@@ -13,9 +13,14 @@ func (app *application) routes() http.Handler {
 
 	r.MethodNotAllowedHandler = http.HandlerFunc(app.methodNotAllowedResponse)
 
+	r.Use(app.recordUser)
+
 	r.HandleFunc("/api/v1/healthcheck", app.healthcheckHandler).Methods("GET")
+	r.HandleFunc("/livez", app.livenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", app.readinessHandler).Methods("GET")
 
 	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.Use(app.rateLimit)
 
 	//Category routes
 	v1.HandleFunc("/categories", app.getCategoriesList).Methods("GET")
@@ -44,6 +49,60 @@ func (app *application) routes() http.Handler {
 	v1.HandleFunc("/users", app.registerUserHandler).Methods("POST")
 	v1.HandleFunc("/users/activated", app.activateUserHandler).Methods("PUT")
 	v1.HandleFunc("/users/login", app.createAuthenticationTokenHandler).Methods("POST")
+	v1.HandleFunc("/users/password", app.updateUserPasswordHandler).Methods("PUT")
+	v1.HandleFunc("/users/email", app.confirmEmailChangeHandler).Methods("PUT")
+	v1.HandleFunc("/users/{id}/lockout", app.requirePermissions("users:write", app.unlockUserHandler)).Methods("DELETE")
+	v1.HandleFunc("/users", app.requirePermissions("users:read", app.listUsersHandler)).Methods("GET")
+	v1.HandleFunc("/users/{id}", app.requirePermissions("users:read", app.showUserHandler)).Methods("GET")
+	v1.HandleFunc("/users/{id}", app.requirePermissions("users:write", app.updateUserHandler)).Methods("PATCH")
+	v1.HandleFunc("/users/{id}", app.requirePermissions("users:write", app.deleteUserHandler)).Methods("DELETE")
+	v1.HandleFunc("/users/{id}/impersonation", app.requirePermissions("users:impersonate", app.requireInteractiveUser(app.createImpersonationTokenHandler))).Methods("POST")
+
+	//Token routes
+	v1.HandleFunc("/tokens/activation", app.createActivationTokenHandler).Methods("POST")
+	v1.HandleFunc("/tokens/password-reset", app.createPasswordResetTokenHandler).Methods("POST")
+	v1.HandleFunc("/tokens/refresh", app.refreshAuthenticationTokenHandler).Methods("POST")
+	v1.HandleFunc("/tokens/2fa", app.createTwoFactorTokenHandler).Methods("POST")
+	v1.HandleFunc("/tokens/authentication", app.requireInteractiveUser(app.deleteAuthenticationTokenHandler)).Methods("DELETE")
+	v1.HandleFunc("/tokens/authentication/all", app.requireInteractiveUser(app.deleteAllAuthenticationTokensHandler)).Methods("DELETE")
+
+	//OIDC routes
+	if app.oidc != nil {
+		v1.HandleFunc("/oidc/login", app.oidcLoginHandler).Methods("GET")
+		v1.HandleFunc("/oidc/callback", app.oidcCallbackHandler).Methods("GET")
+	}
+
+	//Me routes
+	v1.HandleFunc("/me", app.requireAuthenticatedUser(app.showCurrentUserHandler)).Methods("GET")
+	v1.HandleFunc("/me", app.requireInteractiveUser(app.updateCurrentUserHandler)).Methods("PATCH")
+	v1.HandleFunc("/me", app.requireInteractiveUser(app.deleteCurrentUserHandler)).Methods("DELETE")
+	v1.HandleFunc("/me/password", app.requireInteractiveUser(app.changePasswordHandler)).Methods("PUT")
+	v1.HandleFunc("/me/email", app.requireInteractiveUser(app.changeEmailHandler)).Methods("PUT")
+	v1.HandleFunc("/me/sessions", app.requireInteractiveUser(app.listSessionsHandler)).Methods("GET")
+	v1.HandleFunc("/me/2fa", app.requireInteractiveUser(app.setupTwoFactorHandler)).Methods("POST")
+	v1.HandleFunc("/me/2fa/verify", app.requireInteractiveUser(app.verifyTwoFactorHandler)).Methods("POST")
+	v1.HandleFunc("/me/2fa", app.requireInteractiveUser(app.disableTwoFactorHandler)).Methods("DELETE")
+	v1.HandleFunc("/me/api-keys", app.requireInteractiveUser(app.listAPIKeysHandler)).Methods("GET")
+	v1.HandleFunc("/me/api-keys", app.requireInteractiveUser(app.createAPIKeyHandler)).Methods("POST")
+	v1.HandleFunc("/me/api-keys/{id}", app.requireInteractiveUser(app.getAPIKeyHandler)).Methods("GET")
+	v1.HandleFunc("/me/api-keys/{id}", app.requireInteractiveUser(app.updateAPIKeyHandler)).Methods("PATCH")
+	v1.HandleFunc("/me/api-keys/{id}", app.requireInteractiveUser(app.deleteAPIKeyHandler)).Methods("DELETE")
+
+	return app.requestID(app.traceRequest(app.logRequest(app.matchRoute(r, app.recoverPanic(app.enableCORS(app.authenticate(r)))))))
+}
+
+// adminRoutes are served on the admin port, when one is configured, so that
+// they can be kept off the public network.
+func (app *application) adminRoutes() http.Handler {
+	r := mux.NewRouter()
+
+	r.NotFoundHandler = http.HandlerFunc(app.notFoundResponse)
+
+	r.MethodNotAllowedHandler = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	r.Handle("/metrics", app.metrics.handler()).Methods("GET")
+	r.HandleFunc("/log-level", app.showLogLevelHandler).Methods("GET")
+	r.HandleFunc("/log-level", app.updateLogLevelHandler).Methods("PUT")
 
-	return app.authenticate(r)
+	return app.recoverPanic(r)
 }
@@ -5,14 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
 func (app *application) serve() error {
+	// Request contexts derive from baseCtx, so that requests still running
+	// when shutdown gives up on them are cancelled, along with their queries.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
@@ -20,6 +27,30 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+
+	var admin *http.Server
+	if app.config.adminPort != 0 {
+		admin = &http.Server{
+			Addr:         net.JoinHostPort(app.config.adminHost, strconv.Itoa(app.config.adminPort)),
+			Handler:      app.adminRoutes(),
+			ErrorLog:     log.New(app.logger, "", 0),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+
+		go func() {
+			app.logger.Info("starting admin server", "addr", admin.Addr)
+
+			err := admin.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error(err.Error(), "addr", admin.Addr)
+			}
+		}()
 	}
 
 	shutdownError := make(chan error)
@@ -29,31 +60,40 @@ func (app *application) serve() error {
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		s := <-quit
 
-		app.logger.PrintInfo("caught signal", map[string]string{
-			"signal": s.String(),
-		})
+		app.logger.Info("caught signal", "signal", s.String())
+
+		// Fail readiness checks straight away, and give load balancers
+		// time to notice before the server stops accepting connections.
+		app.draining.Store(true)
+		if app.config.drainDelay > 0 {
+			app.logger.Info("draining", "delay", app.config.drainDelay)
+			time.Sleep(app.config.drainDelay)
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if admin != nil {
+			if err := admin.Shutdown(ctx); err != nil {
+				app.logger.Error(err.Error(), "addr", admin.Addr)
+			}
+		}
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
+			cancelRequests()
 			shutdownError <- err
+			return
 		}
 
-		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
-		})
+		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
 		app.wg.Wait()
 		shutdownError <- nil
 
 	}()
 
-	app.logger.PrintInfo("starting server", map[string]string{
-		"addr": srv.Addr,
-		"env":  app.config.env,
-	})
+	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
 
 	err := srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
@@ -65,9 +105,7 @@ func (app *application) serve() error {
 		return err
 	}
 
-	app.logger.PrintInfo("stopped server", map[string]string{
-		"addr": srv.Addr,
-	})
+	app.logger.Info("stopped server", "addr", srv.Addr)
 
 	return nil
 }
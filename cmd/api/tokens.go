@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/godra-y/go-project/pkg/api/model"
 	"github.com/godra-y/go-project/pkg/api/validator"
 	"net/http"
+	"strings"
 	"time"
 )
 
+const activationTokenTTL = 3 * 24 * time.Hour
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -25,14 +29,32 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	model.ValidatePasswordPlaintext(v, input.Password)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	ip := app.clientIP(r)
+
+	if wait := app.loginFailures.Blocked(ip); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
 		return
 	}
 
-	user, err := app.models.User.GetByEmail(input.Email)
+	user, err := app.models.User.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
+			// Unknown addresses get locked out like accounts do, so the
+			// response doesn't tell them apart.
+			email := strings.ToLower(input.Email)
+			if wait := app.unknownEmails.Blocked(email); wait > 0 {
+				app.accountLockedResponse(w, r, wait)
+				return
+			}
+
+			model.CompareDummyPassword(input.Password)
+			app.loginFailures.Fail(ip)
+			app.unknownEmails.Fail(email)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -40,6 +62,17 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	lockout, err := app.models.Lockouts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked, wait := lockout.Locked(); locked {
+		app.accountLockedResponse(w, r, wait)
+		return
+	}
+
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -47,18 +80,387 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		app.loginFailures.Fail(ip)
+
+		err = app.recordLoginFailure(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, model.ScopeAuthentication)
+	if lockout.Failures > 0 {
+		err = app.models.Lockouts.Reset(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Hashes made with an older algorithm or parameters can only be upgraded
+	// while the plaintext is at hand. Failing to do so isn't a reason to
+	// refuse the login.
+	if user.Password.NeedsRehash() {
+		err = app.rehashPassword(r.Context(), user, input.Password)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin responds to a login whose first factor has been checked,
+// with a password or through the identity provider. With two-factor
+// authentication enabled that only earns a short-lived token that must be
+// exchanged, along with a code, at POST /tokens/2fa. A deactivated user is
+// refused here, after their credentials have been checked, so the response
+// doesn't reveal that to someone who only knows the email address.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *model.User) {
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf != nil && tf.Enabled {
+		pending, err := app.models.Tokens.New(r.Context(), user.ID, twoFactorTokenTTL, model.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, r, http.StatusAccepted, envelope{"2fa_pending_token": pending}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, refresh, err := app.issueTokens(r, user, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	// The response is the same whether or not the email matches an activated
+	// account, so this endpoint can't be used to find out who has one.
+	env := envelope{"message": "if an account with that email address exists, password reset instructions have been sent to it"}
+
+	user, err := app.models.User.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.writeJSON(w, r, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated || user.Deactivated {
+		app.writeJSON(w, r, http.StatusAccepted, env, nil)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, model.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(r, user.ID, user.Email, "token_password_reset", map[string]interface{}{
+		"passwordResetToken": token.Plaintext,
+	})
+
+	err = app.writeJSON(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	// As in the rateLimit middleware, a store that can't be reached lets the
+	// request through rather than failing it.
+	result, err := app.limiter.store.Take(r.Context(), "activation|"+strings.ToLower(input.Email), activationLimit)
+	if err != nil {
+		app.logError(r, err)
+		result.Allowed = true
+	}
+
+	if !result.Allowed {
+		setRetryAfter(w, result.RetryAfter)
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	// As with password resets, unknown, deactivated and already activated
+	// accounts get exactly the same response.
+	env := envelope{"message": "if an inactive account with that email address exists, a new activation token has been sent to it"}
+
+	user, err := app.models.User.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.writeJSON(w, r, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated || user.Deactivated {
+		app.writeJSON(w, r, http.StatusAccepted, env, nil)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, activationTokenTTL, model.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(r, user.ID, user.Email, "token_activation", map[string]interface{}{
+		"activationToken": token.Plaintext,
+	})
+
+	err = app.writeJSON(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	// A JWT can't be deleted, but it is refused once its family is gone.
+	switch hash, family := app.contextGetTokenHash(r), app.contextGetTokenFamily(r); {
+	case hash != nil:
+		err = app.models.Tokens.DeleteSession(r.Context(), hash)
+	case family != nil:
+		err = app.models.Tokens.DeleteFamily(r.Context(), family, "")
+	default:
+		app.authenticationRequiredResponse(w, r)
+		return
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeSessions(r.Context(), user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "you have been signed out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	refresh, err := app.models.Tokens.Get(r.Context(), model.ScopeRefresh, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Each refresh token may only be exchanged once. Seeing one again means it
+	// has leaked, so the whole family is revoked and everyone holding a token
+	// from it, legitimate client included, has to sign in again.
+	ok := refresh.UsedAt == nil
+	if ok {
+		ok, err = app.models.Tokens.MarkUsed(r.Context(), refresh.Hash)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !ok {
+		app.requestLogger(r).Info("refresh token reused, revoking token family", "user_id", refresh.UserID)
+
+		err = app.models.Tokens.DeleteFamily(r.Context(), refresh.Family, "")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidRefreshTokenResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteFamily(r.Context(), refresh.Family, model.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.User.Get(r.Context(), refresh.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	token, newRefresh, err := app.issueTokens(r, user, refresh.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": newRefresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issueTokens creates an access token and refresh token for user in the
+// given family, or in a new family if it is nil. In JWT mode the access
+// token is a signed JWT and only the refresh token is stored.
+func (app *application) issueTokens(r *http.Request, user *model.User, family []byte) (*model.Token, *model.Token, error) {
+	if app.jwt == nil {
+		return app.models.Tokens.NewPair(r.Context(), user.ID, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, userAgent(r), family)
+	}
+
+	refresh, err := app.models.Tokens.NewInFamily(r.Context(), user.ID, app.config.tokens.refreshTTL, model.ScopeRefresh, userAgent(r), family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, err := app.newAccessJWT(user, refresh.Family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+func (app *application) rehashPassword(ctx context.Context, user *model.User, plaintext string) error {
+	err := user.Password.Set(plaintext)
+	if err != nil {
+		return err
+	}
+
+	return app.models.User.Update(ctx, user)
+}
+
+// revokeSessions signs a user out everywhere by deleting all of their
+// authentication and refresh tokens.
+func (app *application) revokeSessions(ctx context.Context, userID int64) error {
+	for _, scope := range []string{model.ScopeAuthentication, model.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(ctx, scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userAgent returns the request's User-Agent, truncated so that a client
+// can't store arbitrarily large values alongside its tokens.
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return ua
+}
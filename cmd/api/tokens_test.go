@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/jsonlog"
+)
+
+const (
+	testRefreshToken = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	testUserID       = int64(7)
+
+	selectTokenQuery  = `SELECT hash, user_id, expiry, scope, user_agent, family, used_at, impersonator_id\s+FROM tokens\s+WHERE hash = \$1 AND scope = \$2`
+	markUsedQuery     = `UPDATE tokens\s+SET used_at = NOW\(\)\s+WHERE hash = \$1 AND used_at IS NULL`
+	deleteFamilyQuery = `DELETE FROM tokens\s+WHERE family = \$1 AND \(scope = \$2 OR \$2 = ''\)`
+	selectUserQuery   = `FROM users\s+WHERE id = \$1`
+	insertTokenQuery  = `INSERT INTO tokens \(hash, user_id, expiry, scope, user_agent, family, impersonator_id\)`
+)
+
+var testFamily = []byte("family-0123456789")
+
+// newTestApp returns an application whose models run against a mock
+// database, so handlers can be tested by the queries they make.
+func newTestApp(t *testing.T) (*application, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	app := &application{
+		db:     db,
+		models: model.NewModels(db, time.Second, slog.New(slog.NewTextHandler(io.Discard, nil))),
+		logger: jsonlog.NewLogger(io.Discard, jsonlog.LevelOff),
+	}
+	app.config.tokens.accessTTL = time.Hour
+	app.config.tokens.refreshTTL = 24 * time.Hour
+
+	return app, mock
+}
+
+func expectRefreshToken(mock sqlmock.Sqlmock, usedAt interface{}) {
+	rows := sqlmock.NewRows([]string{"hash", "user_id", "expiry", "scope", "user_agent", "family", "used_at", "impersonator_id"}).
+		AddRow(model.HashToken(testRefreshToken), testUserID, time.Now().Add(time.Hour), model.ScopeRefresh, "test", testFamily, usedAt, nil)
+
+	mock.ExpectQuery(selectTokenQuery).
+		WithArgs(model.HashToken(testRefreshToken), model.ScopeRefresh, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+func refresh(app *application) *httptest.ResponseRecorder {
+	body := strings.NewReader(`{"refresh_token": "` + testRefreshToken + `"}`)
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/refresh", body)
+	w := httptest.NewRecorder()
+
+	app.refreshAuthenticationTokenHandler(w, r)
+	return w
+}
+
+func TestRefreshRotation(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	expectRefreshToken(mock, nil)
+	mock.ExpectExec(markUsedQuery).
+		WithArgs(model.HashToken(testRefreshToken)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Access tokens issued from the old refresh token stop working.
+	mock.ExpectExec(deleteFamilyQuery).
+		WithArgs(testFamily, model.ScopeAuthentication).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectUserQuery).
+		WithArgs(testUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "name", "email", "password_hash", "activated", "deactivated", "version"}).
+			AddRow(testUserID, time.Now(), "Alice", "alice@example.com", []byte("hash"), true, false, 1))
+	// The new pair stays in the family.
+	mock.ExpectExec(insertTokenQuery).
+		WithArgs(sqlmock.AnyArg(), testUserID, sqlmock.AnyArg(), model.ScopeAuthentication, sqlmock.AnyArg(), testFamily, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertTokenQuery).
+		WithArgs(sqlmock.AnyArg(), testUserID, sqlmock.AnyArg(), model.ScopeRefresh, sqlmock.AnyArg(), testFamily, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := refresh(app)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var body struct {
+		Access  struct{ Token string } `json:"authentication_token"`
+		Refresh struct{ Token string } `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Refresh.Token == "" || body.Refresh.Token == testRefreshToken {
+		t.Errorf("got refresh token %q; want a new one", body.Refresh.Token)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		usedAt interface{}
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:   "already used",
+			usedAt: time.Now().Add(-time.Minute),
+			expect: func(mock sqlmock.Sqlmock) {},
+		},
+		{
+			// Two requests read the token before either marked it used.
+			// Only one of them may win the update.
+			name:   "used concurrently",
+			usedAt: nil,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(markUsedQuery).
+					WithArgs(model.HashToken(testRefreshToken)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+
+			expectRefreshToken(mock, tt.usedAt)
+			tt.expect(mock)
+			// The whole family is revoked, whatever the scope.
+			mock.ExpectExec(deleteFamilyQuery).
+				WithArgs(testFamily, "").
+				WillReturnResult(sqlmock.NewResult(0, 3))
+
+			w := refresh(app)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got status %d; want %d", w.Code, http.StatusUnauthorized)
+			}
+			if !strings.Contains(w.Body.String(), "refresh token") {
+				t.Errorf("got body %s", w.Body)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRefreshDeactivatedUser(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	expectRefreshToken(mock, nil)
+	mock.ExpectExec(markUsedQuery).
+		WithArgs(model.HashToken(testRefreshToken)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(deleteFamilyQuery).
+		WithArgs(testFamily, model.ScopeAuthentication).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectUserQuery).
+		WithArgs(testUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "name", "email", "password_hash", "activated", "deactivated", "version"}).
+			AddRow(testUserID, time.Now(), "Alice", "alice@example.com", []byte("hash"), true, true, 1))
+
+	w := refresh(app)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusForbidden)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshUnknownToken(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectQuery(selectTokenQuery).
+		WithArgs(model.HashToken(testRefreshToken), model.ScopeRefresh, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+
+	w := refresh(app)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusUnauthorized)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/model"
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/godra-y/go-project/pkg/totp"
+)
+
+const (
+	totpIssuer        = "Marvel Shop"
+	twoFactorTokenTTL = 5 * time.Minute
+)
+
+func (app *application) setupTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf != nil && tf.Enabled {
+		app.twoFactorConflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Begin(r.Context(), user.ID, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"two_factor": map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(secret, totpIssuer, user.Email),
+	}}
+
+	err = app.writeJSON(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) verifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	v := validator.New()
+
+	tf, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("code", "two-factor setup has not been started")
+			app.failedValidationResponse(w, r, v.Messages)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Enabled {
+		app.twoFactorConflictResponse(w, r, "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	_, err = app.models.TwoFactor.UseStep(r.Context(), user.ID, step)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.TwoFactor.Enable(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, model.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf == nil || !tf.Enabled {
+		app.twoFactorConflictResponse(w, r, "two-factor authentication is not enabled")
+		return
+	}
+
+	ip := app.clientIP(r)
+
+	if wait := app.loginFailures.Blocked(ip); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return
+	}
+
+	lockout, err := app.models.Lockouts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked, wait := lockout.Locked(); locked {
+		app.accountLockedResponse(w, r, wait)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(r.Context(), tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// As at login, wrong codes count towards the lockout, so that a stolen
+	// session can't be used to guess its way to turning the second factor
+	// off.
+	if !ok {
+		app.loginFailures.Fail(ip)
+
+		err = app.recordLoginFailure(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		v := validator.New()
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	if lockout.Failures > 0 {
+		err = app.models.Lockouts.Reset(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.TwoFactor.Disable(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTwoFactorTokenHandler completes a login started with a password by
+// exchanging the 2fa_pending token and a TOTP or recovery code for the usual
+// authentication and refresh tokens.
+func (app *application) createTwoFactorTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	model.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	ip := app.clientIP(r)
+
+	if wait := app.loginFailures.Blocked(ip); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return
+	}
+
+	user, err := app.models.User.GetForToken(r.Context(), model.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Messages)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	lockout, err := app.models.Lockouts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked, wait := lockout.Locked(); locked {
+		app.accountLockedResponse(w, r, wait)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(r.Context(), tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Wrong codes count towards the same limits as wrong passwords, otherwise
+	// the six digits could simply be guessed.
+	if !ok {
+		app.loginFailures.Fail(ip)
+
+		err = app.recordLoginFailure(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidTwoFactorCodeResponse(w, r)
+		return
+	}
+
+	if lockout.Failures > 0 {
+		err = app.models.Lockouts.Reset(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, refresh, err := app.issueTokens(r, user, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSecondFactor accepts either a current TOTP code, which can only be
+// used once, or one of the user's unused recovery codes.
+func (app *application) checkSecondFactor(ctx context.Context, tf *model.TwoFactor, code string) (bool, error) {
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(tf.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return app.models.TwoFactor.UseStep(ctx, tf.UserID, step)
+	}
+
+	return app.models.TwoFactor.UseRecoveryCode(ctx, tf.UserID, code)
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/godra-y/go-project/pkg/api/model"
 	"github.com/godra-y/go-project/pkg/api/validator"
 	"net/http"
-	"time"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -35,38 +34,48 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 
 	if model.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	err = app.models.User.Insert(user)
+	err = app.models.User.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
 
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v.Messages)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, model.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, activationTokenTTL, model.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.sendEmail(r, user.ID, user.Email, "user_welcome", map[string]interface{}{
+		"activationToken": token.Plaintext,
+		"userID":          user.ID,
+	})
+
 	var res struct {
-		Token *string     `json:"token"`
+		Token *string     `json:"token,omitempty"`
 		User  *model.User `json:"user"`
 	}
 
-	res.Token = &token.Plaintext
+	// Handing out the token here lets anyone activate an account for an email
+	// address they don't own, so it's only done outside production to make
+	// local testing easier.
+	if app.config.env != "production" {
+		res.Token = &token.Plaintext
+	}
 	res.User = user
 
-	app.writeJSON(w, http.StatusCreated, envelope{"user": res}, nil)
+	app.writeJSON(w, r, http.StatusCreated, envelope{"user": res}, nil)
 }
 
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,27 +92,174 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 
 	if model.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v.Messages)
 		return
 	}
 
-	user, err := app.models.User.GetForToken(model.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.User.GetForToken(r.Context(), model.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, model.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v.Messages)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
 	user.Activated = true
 
-	err = app.models.User.Update(user)
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+}
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	model.ValidatePasswordPlaintext(v, input.Password)
+	model.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	user, err := app.models.User.GetForToken(r.Context(), model.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Messages)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The rest of the policy needs the user, to check the password doesn't
+	// contain their name or email.
+	if model.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The reset token is single use, and anyone who was signed in with the
+	// old password shouldn't stay signed in.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeSessions(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if model.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Messages)
+		return
+	}
+
+	user, err := app.models.User.GetForToken(r.Context(), model.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Messages)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	email, err := app.models.EmailChange.Get(r.Context(), user.ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, model.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Messages)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = email
+
+	err = app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Messages)
 		case errors.Is(err, model.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -112,11 +268,20 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(model.ScopeActivation, user.ID)
+	err = app.models.EmailChange.Delete(r.Context(), user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), model.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
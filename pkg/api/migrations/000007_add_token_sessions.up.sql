@@ -0,0 +1,6 @@
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP(0) WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS user_agent   TEXT                        NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
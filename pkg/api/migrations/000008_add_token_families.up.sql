@@ -0,0 +1,5 @@
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS family  BYTEA,
+    ADD COLUMN IF NOT EXISTS used_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
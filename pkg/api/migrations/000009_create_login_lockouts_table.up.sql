@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS login_lockouts
+(
+    user_id        BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    failures       INTEGER                     NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until   TIMESTAMP(0) WITH TIME ZONE
+);
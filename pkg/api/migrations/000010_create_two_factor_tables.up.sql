@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS two_factor
+(
+    user_id        BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    secret         TEXT                        NOT NULL,
+    enabled        BOOL                        NOT NULL DEFAULT FALSE,
+    last_used_step BIGINT                      NOT NULL DEFAULT 0,
+    created_at     TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    hash    BYTEA PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE
+);
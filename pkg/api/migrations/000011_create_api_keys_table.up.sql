@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      BIGINT                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    name         TEXT                        NOT NULL,
+    prefix       TEXT                        NOT NULL,
+    hash         BYTEA UNIQUE                NOT NULL,
+    permissions  TEXT[]                      NOT NULL DEFAULT '{}',
+    expiry       TIMESTAMP(0) WITH TIME ZONE,
+    last_used_at TIMESTAMP(0) WITH TIME ZONE,
+    created_at   TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    version      INTEGER                     NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_identities
+(
+    issuer     TEXT                        NOT NULL,
+    subject    TEXT                        NOT NULL,
+    user_id    BIGINT                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (issuer, subject)
+);
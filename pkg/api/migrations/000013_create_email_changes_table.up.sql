@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS email_changes
+(
+    user_id    BIGINT PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    email      CITEXT                      NOT NULL,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code IN ('users:read', 'users:impersonate');
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS impersonator_id;
@@ -0,0 +1,6 @@
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS impersonator_id BIGINT REFERENCES users ON DELETE CASCADE;
+
+INSERT INTO permissions (code)
+VALUES ('users:read'),
+       ('users:impersonate');
@@ -0,0 +1,3 @@
+INSERT INTO permissions (code)
+SELECT 'users:write'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:write');
@@ -0,0 +1,344 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"github.com/lib/pq"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key so they are easy to recognise, for
+// example by secret scanners.
+const apiKeyPrefix = "mk_"
+
+// APIKey lets a machine client act as the user that owns it, limited to the
+// permissions listed on the key.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name" validate:"required,max=100"`
+	Plaintext   string      `json:"key,omitempty"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions" validate:"unique"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Version     int         `json:"-"`
+}
+
+type APIKeyModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
+}
+
+// Insert generates the key's secret and stores its hash. The plaintext is
+// left on the struct so it can be shown to the user once.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.Insert")
+	defer span.End()
+
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+8]
+	key.Hash = HashToken(key.Plaintext)
+
+	if key.Permissions == nil {
+		key.Permissions = Permissions{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, version
+		`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+}
+
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT id, user_id, name, prefix, permissions, expiry, last_used_at, created_at, version
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.Logger.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.CreatedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Get returns one of a user's keys. Keys owned by someone else are reported
+// as not found.
+func (m APIKeyModel) Get(ctx context.Context, id, userID int64) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.Get")
+	defer span.End()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, user_id, name, prefix, permissions, expiry, last_used_at, created_at, version
+		FROM api_keys
+		WHERE id = $1 AND user_id = $2
+		`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.CreatedAt,
+		&key.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+func (m APIKeyModel) Update(ctx context.Context, key *APIKey) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.Update")
+	defer span.End()
+
+	query := `
+		UPDATE api_keys
+		SET name = $1, permissions = $2, expiry = $3, version = version + 1
+		WHERE id = $4 AND user_id = $5 AND version = $6
+		RETURNING version
+		`
+
+	args := []interface{}{key.Name, pq.Array(key.Permissions), key.Expiry, key.ID, key.UserID, key.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteAllForUser removes every API key belonging to a user.
+func (m APIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.DeleteAllForUser")
+	defer span.End()
+
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.Delete")
+	defer span.End()
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForKey looks up an unexpired key by its plaintext and returns it with
+// the user that owns it.
+func (m APIKeyModel) GetForKey(ctx context.Context, keyPlaintext string) (*User, *APIKey, error) {
+	ctx, span := startSpan(ctx, "APIKeyModel.GetForKey")
+	defer span.End()
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email,
+		       users.password_hash, users.activated, users.deactivated, users.version,
+		       api_keys.id, api_keys.name, api_keys.prefix, api_keys.permissions, api_keys.expiry
+		FROM api_keys
+		INNER JOIN users
+			ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+			AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+		`
+
+	var (
+		user User
+		key  APIKey
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, HashToken(keyPlaintext), time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	return &user, &key, nil
+}
+
+// Touch records that a key has just been used, at most once a minute.
+func (m APIKeyModel) Touch(ctx context.Context, id int64) error {
+	ctx, span := startSpan(ctx, "APIKeyModel.Touch")
+	defer span.End()
+
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1
+			AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(apiKeyPrefix)+32, "key", "must be a valid API key")
+}
+
+// ValidateAPIKey checks a key's fields. granted are the permissions of the
+// owning user; a key can't be given any the user doesn't have.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, granted Permissions) {
+	v.Struct(key)
+
+	for _, code := range key.Permissions {
+		v.Check(granted.Include(code), "permissions", "must only contain permissions you have")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
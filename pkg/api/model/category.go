@@ -5,22 +5,25 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/godra-y/go-project/pkg/api/validator"
-	"log"
+	"log/slog"
 	"time"
 )
 
 type Category struct {
 	ID   int    `json:"id"`
-	Name string `json:"name"`
+	Name string `json:"name" validate:"required,max=100"`
 }
 
 type CategoryModel struct {
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
 }
 
-func (cm CategoryModel) GetAll(name string, filters Filters) ([]*Category, Metadata, error) {
+func (cm CategoryModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Category, Metadata, error) {
+	ctx, span := startSpan(ctx, "CategoryModel.GetAll")
+	defer span.End()
+
 	query := fmt.Sprintf(`
         SELECT count(*) OVER(), id, name
         FROM categories
@@ -29,7 +32,7 @@ func (cm CategoryModel) GetAll(name string, filters Filters) ([]*Category, Metad
         LIMIT $2 OFFSET $3
     `, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, cm.QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{name, filters.limit(), filters.offset()}
@@ -40,7 +43,7 @@ func (cm CategoryModel) GetAll(name string, filters Filters) ([]*Category, Metad
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			cm.ErrorLog.Println(err)
+			cm.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -67,7 +70,10 @@ func (cm CategoryModel) GetAll(name string, filters Filters) ([]*Category, Metad
 	return categories, metadata, nil
 }
 
-func (cm CategoryModel) Insert(category *Category) error {
+func (cm CategoryModel) Insert(ctx context.Context, category *Category) error {
+	ctx, span := startSpan(ctx, "CategoryModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO categories (name)
 		VALUES ($1)
@@ -75,13 +81,16 @@ func (cm CategoryModel) Insert(category *Category) error {
 	`
 
 	args := []interface{}{category.Name}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, cm.QueryTimeout)
 	defer cancel()
 
 	return cm.DB.QueryRowContext(ctx, query, args...).Scan(&category.ID)
 }
 
-func (cm CategoryModel) Get(id int) (*Category, error) {
+func (cm CategoryModel) Get(ctx context.Context, id int) (*Category, error) {
+	ctx, span := startSpan(ctx, "CategoryModel.Get")
+	defer span.End()
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -93,7 +102,7 @@ func (cm CategoryModel) Get(id int) (*Category, error) {
 	`
 
 	var category Category
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, cm.QueryTimeout)
 	defer cancel()
 
 	row := cm.DB.QueryRowContext(ctx, query, id)
@@ -104,7 +113,10 @@ func (cm CategoryModel) Get(id int) (*Category, error) {
 	return &category, nil
 }
 
-func (cm CategoryModel) Update(category *Category) error {
+func (cm CategoryModel) Update(ctx context.Context, category *Category) error {
+	ctx, span := startSpan(ctx, "CategoryModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE categories
 		SET name = $1
@@ -112,13 +124,16 @@ func (cm CategoryModel) Update(category *Category) error {
 		RETURNING id
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, cm.QueryTimeout)
 	defer cancel()
 
 	return cm.DB.QueryRowContext(ctx, query, category.Name, category.ID).Scan(&category.ID)
 }
 
-func (сm CategoryModel) Delete(id int) error {
+func (сm CategoryModel) Delete(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "CategoryModel.Delete")
+	defer span.End()
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -128,7 +143,7 @@ func (сm CategoryModel) Delete(id int) error {
 		WHERE id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, сm.QueryTimeout)
 	defer cancel()
 
 	_, err := сm.DB.ExecContext(ctx, query, id)
@@ -136,6 +151,5 @@ func (сm CategoryModel) Delete(id int) error {
 }
 
 func ValidateCategory(v *validator.Validator, category *Category) {
-	v.Check(category.Name != "", "name", "must be provided")
-	v.Check(len(category.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Struct(category)
 }
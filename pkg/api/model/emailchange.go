@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// EmailChangeModel holds the address a user has asked to move to until they
+// confirm it with the token sent there. A user has at most one pending change.
+type EmailChangeModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
+}
+
+func (m EmailChangeModel) Set(ctx context.Context, userID int64, email string) error {
+	ctx, span := startSpan(ctx, "EmailChangeModel.Set")
+	defer span.End()
+
+	query := `
+		INSERT INTO email_changes (user_id, email)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET email = EXCLUDED.email, created_at = NOW()
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, email)
+	return err
+}
+
+func (m EmailChangeModel) Get(ctx context.Context, userID int64) (string, error) {
+	ctx, span := startSpan(ctx, "EmailChangeModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT email
+		FROM email_changes
+		WHERE user_id = $1
+		`
+
+	var email string
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return email, nil
+}
+
+func (m EmailChangeModel) Delete(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "EmailChangeModel.Delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM email_changes
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// IdentityModel links users to accounts at external identity providers,
+// identified by the provider's issuer and the subject it gives the user.
+type IdentityModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
+}
+
+func (m IdentityModel) GetUser(ctx context.Context, issuer, subject string) (*User, error) {
+	ctx, span := startSpan(ctx, "IdentityModel.GetUser")
+	defer span.End()
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email,
+		       users.password_hash, users.activated, users.deactivated, users.version
+		FROM users
+		INNER JOIN user_identities
+			ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2
+		`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m IdentityModel) Link(ctx context.Context, issuer, subject string, userID int64) error {
+	ctx, span := startSpan(ctx, "IdentityModel.Link")
+	defer span.End()
+
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	return err
+}
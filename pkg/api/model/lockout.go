@@ -0,0 +1,124 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Lockout tracks consecutive failed logins for a user account.
+type Lockout struct {
+	UserID      int64
+	Failures    int
+	LockedUntil *time.Time
+}
+
+// Locked reports whether the account is currently locked and, if so, for how
+// much longer.
+func (l *Lockout) Locked() (bool, time.Duration) {
+	if l.LockedUntil == nil {
+		return false, 0
+	}
+
+	remaining := time.Until(*l.LockedUntil)
+	return remaining > 0, remaining
+}
+
+type LockoutModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
+}
+
+// Get returns the lockout state for a user. Users without failed logins get
+// an empty Lockout rather than ErrRecordNotFound.
+func (m LockoutModel) Get(ctx context.Context, userID int64) (*Lockout, error) {
+	ctx, span := startSpan(ctx, "LockoutModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT failures, locked_until
+		FROM login_lockouts
+		WHERE user_id = $1
+		`
+
+	lockout := Lockout{UserID: userID}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&lockout.Failures, &lockout.LockedUntil)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &lockout, nil
+}
+
+// RecordFailure counts a failed login. Failures older than a day are
+// forgotten, so the count starts again from one.
+func (m LockoutModel) RecordFailure(ctx context.Context, userID int64) (*Lockout, error) {
+	ctx, span := startSpan(ctx, "LockoutModel.RecordFailure")
+	defer span.End()
+
+	query := `
+		INSERT INTO login_lockouts (user_id, failures, last_failed_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET failures = CASE
+				WHEN login_lockouts.last_failed_at < NOW() - INTERVAL '1 day' THEN 1
+				ELSE login_lockouts.failures + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING failures, locked_until
+		`
+
+	lockout := Lockout{UserID: userID}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&lockout.Failures, &lockout.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockout, nil
+}
+
+func (m LockoutModel) Lock(ctx context.Context, userID int64, until time.Time) error {
+	ctx, span := startSpan(ctx, "LockoutModel.Lock")
+	defer span.End()
+
+	query := `
+		UPDATE login_lockouts
+		SET locked_until = $2
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, until)
+	return err
+}
+
+// Reset clears failed logins and any lock, after a successful login or when
+// an administrator unlocks the account.
+func (m LockoutModel) Reset(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "LockoutModel.Reset")
+	defer span.End()
+
+	query := `
+		DELETE FROM login_lockouts
+		WHERE user_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
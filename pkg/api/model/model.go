@@ -1,10 +1,16 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"log"
-	"os"
+	"log/slog"
+	"time"
+
+	"github.com/godra-y/go-project/pkg/api/validator"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -13,6 +19,12 @@ var (
 	ErrEditConflict = errors.New("edit conflict")
 )
 
+// The validate tags of these types are checked at startup, so that a
+// mistake in one stops the program instead of failing requests.
+func init() {
+	validator.MustRegister(Product{}, Category{}, Order{}, APIKey{})
+}
+
 type Models struct {
 	User        UserModel
 	Product     ProductModel
@@ -20,41 +32,78 @@ type Models struct {
 	Tokens      TokenModel
 	Permissions PermissionModel
 	Order       OrderModel
+	Lockouts    LockoutModel
+	TwoFactor   TwoFactorModel
+	APIKeys     APIKeyModel
+	Identities  IdentityModel
+	EmailChange EmailChangeModel
 }
 
-func NewModels(db *sql.DB) Models {
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+// NewModels returns the models backed by db. Every query is given at most
+// queryTimeout to complete, on top of any deadline of its context.
+func NewModels(db *sql.DB, queryTimeout time.Duration, logger *slog.Logger) Models {
 	return Models{
 		User: UserModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 		Product: ProductModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 		Category: CategoryModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 		Order: OrderModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 		Tokens: TokenModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 		Permissions: PermissionModel{
-			DB:       db,
-			InfoLog:  infoLog,
-			ErrorLog: errorLog,
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
+		},
+		Lockouts: LockoutModel{
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
+		},
+		TwoFactor: TwoFactorModel{
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
+		},
+		APIKeys: APIKeyModel{
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
+		},
+		Identities: IdentityModel{
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
+		},
+		EmailChange: EmailChangeModel{
+			DB:           db,
+			QueryTimeout: queryTimeout,
+			Logger:       logger,
 		},
 	}
 }
+
+var tracer = otel.Tracer("github.com/godra-y/go-project/pkg/api/model")
+
+// startSpan starts the span of a model method, named like "UserModel.Get".
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("db.system", "postgresql")))
+}
@@ -5,24 +5,27 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/godra-y/go-project/pkg/api/validator"
-	"log"
+	"log/slog"
 	"time"
 )
 
 type Order struct {
 	ID        int    `json:"id"`
-	ProductID int    `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	ProductID int    `json:"product_id" validate:"gt=0"`
+	Quantity  int    `json:"quantity" validate:"gt=0"`
 	CreatedAt string `json:"created_at"`
 }
 
 type OrderModel struct {
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
 }
 
-func (om OrderModel) GetAll(filters Filters) ([]*Order, Metadata, error) {
+func (om OrderModel) GetAll(ctx context.Context, filters Filters) ([]*Order, Metadata, error) {
+	ctx, span := startSpan(ctx, "OrderModel.GetAll")
+	defer span.End()
+
 	query := fmt.Sprintf(
 		`
 		SELECT count(*) OVER(), id, product_id, quantity, created_at
@@ -32,7 +35,7 @@ func (om OrderModel) GetAll(filters Filters) ([]*Order, Metadata, error) {
 		`,
 		filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{filters.limit(), filters.offset()}
@@ -43,7 +46,7 @@ func (om OrderModel) GetAll(filters Filters) ([]*Order, Metadata, error) {
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			om.ErrorLog.Println(err)
+			om.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -68,7 +71,10 @@ func (om OrderModel) GetAll(filters Filters) ([]*Order, Metadata, error) {
 	return orders, metadata, nil
 }
 
-func (om OrderModel) Insert(order *Order) error {
+func (om OrderModel) Insert(ctx context.Context, order *Order) error {
+	ctx, span := startSpan(ctx, "OrderModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO orders (product_id, quantity) 
 		VALUES ($1, $2) 
@@ -76,13 +82,16 @@ func (om OrderModel) Insert(order *Order) error {
 		`
 
 	args := []interface{}{order.ProductID, order.Quantity}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	return om.DB.QueryRowContext(ctx, query, args...).Scan(&order.ID, &order.CreatedAt)
 }
 
-func (om OrderModel) Get(id int) (*Order, error) {
+func (om OrderModel) Get(ctx context.Context, id int) (*Order, error) {
+	ctx, span := startSpan(ctx, "OrderModel.Get")
+	defer span.End()
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -94,7 +103,7 @@ func (om OrderModel) Get(id int) (*Order, error) {
 		`
 
 	var order Order
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	row := om.DB.QueryRowContext(ctx, query, id)
@@ -105,7 +114,10 @@ func (om OrderModel) Get(id int) (*Order, error) {
 	return &order, nil
 }
 
-func (om OrderModel) GetOrdersByProduct(productID int, filters Filters) ([]*Order, Metadata, error) {
+func (om OrderModel) GetOrdersByProduct(ctx context.Context, productID int, filters Filters) ([]*Order, Metadata, error) {
+	ctx, span := startSpan(ctx, "OrderModel.GetOrdersByProduct")
+	defer span.End()
+
 	query := fmt.Sprintf(
 		`
 		SELECT count(*) OVER(), id, product_id, quantity, created_at
@@ -116,7 +128,7 @@ func (om OrderModel) GetOrdersByProduct(productID int, filters Filters) ([]*Orde
 		`,
 		filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{productID, filters.limit(), filters.offset()}
@@ -127,7 +139,7 @@ func (om OrderModel) GetOrdersByProduct(productID int, filters Filters) ([]*Orde
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			om.ErrorLog.Println(err)
+			om.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -152,7 +164,10 @@ func (om OrderModel) GetOrdersByProduct(productID int, filters Filters) ([]*Orde
 	return orders, metadata, nil
 }
 
-func (om OrderModel) Update(order *Order) error {
+func (om OrderModel) Update(ctx context.Context, order *Order) error {
+	ctx, span := startSpan(ctx, "OrderModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE orders
 		SET product_id = $1, quantity = $2
@@ -161,13 +176,16 @@ func (om OrderModel) Update(order *Order) error {
 		`
 
 	args := []interface{}{order.ProductID, order.Quantity, order.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	return om.DB.QueryRowContext(ctx, query, args...).Scan(&order.ID)
 }
 
-func (om OrderModel) Delete(id int) error {
+func (om OrderModel) Delete(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "OrderModel.Delete")
+	defer span.End()
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -176,7 +194,7 @@ func (om OrderModel) Delete(id int) error {
 		DELETE FROM orders
 		WHERE id = $1
 		`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, om.QueryTimeout)
 	defer cancel()
 
 	_, err := om.DB.ExecContext(ctx, query, id)
@@ -184,6 +202,5 @@ func (om OrderModel) Delete(id int) error {
 }
 
 func ValidateOrder(v *validator.Validator, order *Order) {
-	v.Check(order.ProductID > 0, "product_id", "must be a positive value")
-	v.Check(order.Quantity > 0, "quantity", "must be a positive value")
+	v.Struct(order)
 }
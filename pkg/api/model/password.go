@@ -0,0 +1,195 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUnknownPasswordHash = errors.New("unrecognised password hash format")
+
+// PasswordHasher creates password hashes. Every hash starts with a prefix
+// naming its algorithm, "$2a$" for bcrypt and "$argon2id$" for argon2id, so
+// hashes made by any supported hasher can still be checked after the hasher
+// is changed.
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+
+	// NeedsRehash reports whether hash was made with a different algorithm
+	// or different parameters than this hasher would use now.
+	NeedsRehash(hash []byte) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt at the given cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id. Memory is in KiB. Hashes
+// are stored in the PHC string format, which records the parameters used.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != h.Memory ||
+		params.Iterations != h.Iterations ||
+		params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength ||
+		uint32(len(key)) != h.KeyLength
+}
+
+func decodeArgon2id(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	// "$argon2id$v=19$m=65536,t=3,p=2$salt$key" splits into
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", "salt", "key".
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+var passwordHasher PasswordHasher = BcryptHasher{Cost: 12}
+
+// SetPasswordHasher changes the hasher used for new passwords. It should be
+// called once at startup, before any passwords are set or checked.
+func SetPasswordHasher(h PasswordHasher) {
+	passwordHasher = h
+}
+
+type password struct {
+	plaintext *string
+	hash      []byte
+}
+
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := passwordHasher.Hash(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = &plaintextPassword
+	p.hash = hash
+	return nil
+}
+
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if params, salt, key, err := decodeArgon2id(p.hash); err == nil {
+		other := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// NeedsRehash reports whether the stored hash should be replaced using the
+// current hasher, which can only be done when the plaintext is known, such
+// as just after a successful login.
+func (p *password) NeedsRehash() bool {
+	return passwordHasher.NeedsRehash(p.hash)
+}
+
+var (
+	dummyPassword     password
+	dummyPasswordOnce sync.Once
+)
+
+// CompareDummyPassword does the same hashing work as Matches against a hash
+// that nothing matches. Logins for unknown emails call it so that they take
+// as long as logins with a wrong password.
+func CompareDummyPassword(plaintextPassword string) {
+	dummyPasswordOnce.Do(func() {
+		_ = dummyPassword.Set("not a real password")
+	})
+
+	_, _ = dummyPassword.Matches(plaintextPassword)
+}
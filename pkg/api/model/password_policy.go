@@ -0,0 +1,213 @@
+package model
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/godra-y/go-project/pkg/api/validator"
+)
+
+// PasswordPolicy is what a new password must satisfy.
+type PasswordPolicy struct {
+	MinLength int
+
+	// MinScore is the lowest acceptable strength score, from 0 (anything
+	// goes) to 4. See passwordScore.
+	MinScore int
+
+	// BreachedDir, if set, is a directory of breached password hashes in
+	// the k-anonymity range format published by Have I Been Pwned: one file
+	// per five character SHA-1 prefix, named like "5BAA6.txt", with a line
+	// for each hash holding the rest of the hash and a count, like
+	// "1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493".
+	BreachedDir string
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 8}
+
+// SetPasswordPolicy changes the policy checked by ValidateNewPassword. It
+// should be called once at startup.
+func SetPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength < 1 || policy.MinLength > 72 {
+		return fmt.Errorf("password minimum length must be between 1 and 72, got %d", policy.MinLength)
+	}
+
+	if policy.MinScore < 0 || policy.MinScore > 4 {
+		return fmt.Errorf("password minimum score must be between 0 and 4, got %d", policy.MinScore)
+	}
+
+	if policy.BreachedDir != "" {
+		info, err := os.Stat(policy.BreachedDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("breached passwords path %q is not a directory", policy.BreachedDir)
+		}
+	}
+
+	passwordPolicy = policy
+	return nil
+}
+
+// ValidatePasswordPlaintext checks that a password is given and no longer
+// than bcrypt accepts. It is all that is checked for passwords given at
+// login, so that tightening the policy, even the minimum length, doesn't lock
+// anyone out.
+func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+}
+
+// ValidateNewPassword checks a password being set against the whole policy.
+// User may be nil if the account isn't known yet.
+func ValidateNewPassword(v *validator.Validator, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+
+	if !v.Valid() {
+		return
+	}
+
+	v.Check(len(password) >= passwordPolicy.MinLength, "password", fmt.Sprintf("must be at least %d bytes long", passwordPolicy.MinLength))
+
+	lower := strings.ToLower(password)
+
+	if user != nil {
+		local, _, _ := strings.Cut(strings.ToLower(user.Email), "@")
+		v.Check(len(local) < 3 || !strings.Contains(lower, local), "password", "must not contain your email address")
+
+		for _, word := range strings.Fields(strings.ToLower(user.Name)) {
+			if len(word) >= 3 && strings.Contains(lower, word) {
+				v.AddError("password", "must not contain your name")
+				break
+			}
+		}
+	}
+
+	v.Check(passwordScore(password) >= passwordPolicy.MinScore, "password", "is too easy to guess")
+
+	v.Check(!passwordBreached(password), "password", "has appeared in a data breach, please choose another")
+}
+
+// passwordBreached looks the password up in the configured breached
+// password files. Only the file for the first five characters of the hash
+// is read. A missing file means no breached password has that prefix; an
+// unreadable one is treated the same, so a problem with the list never stops
+// people setting passwords.
+func passwordBreached(password string) bool {
+	if passwordPolicy.BreachedDir == "" {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(passwordPolicy.BreachedDir, prefix+".txt"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commonPasswords are fragments so common in passwords that they add almost
+// nothing to the guesses needed.
+var commonPasswords = []string{
+	"password", "qwerty", "letmein", "welcome", "admin", "login", "iloveyou",
+	"monkey", "dragon", "master", "sunshine", "princess", "football",
+	"baseball", "shadow", "superman", "trustno1", "marvel",
+}
+
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+)
+
+// passwordScore estimates how hard a password is to guess, on the same 0-4
+// scale as zxcvbn. The guess count is the character set size raised to the
+// password's effective length, where repeated characters, runs such as
+// "abcd" or "4321", and common password fragments barely count.
+func passwordScore(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	charset := 0
+	if lower {
+		charset += 26
+	}
+	if upper {
+		charset += 26
+	}
+	if digit {
+		charset += 10
+	}
+	if other {
+		charset += 33
+	}
+	if charset == 0 {
+		return 0
+	}
+
+	runes := []rune(strings.ToLower(password))
+	length := 0
+	for i, r := range runes {
+		if i > 0 {
+			d := r - runes[i-1]
+			if d == 0 || d == 1 || d == -1 {
+				continue
+			}
+		}
+		length++
+	}
+
+	normalized := leetReplacer.Replace(strings.ToLower(password))
+	for _, word := range commonPasswords {
+		if strings.Contains(normalized, word) {
+			length -= len(word) - 1
+		}
+	}
+	if length < 1 {
+		length = 1
+	}
+
+	logGuesses := float64(length) * math.Log10(float64(charset))
+
+	switch {
+	case logGuesses < 3:
+		return 0
+	case logGuesses < 6:
+		return 1
+	case logGuesses < 8:
+		return 2
+	case logGuesses < 10:
+		return 3
+	}
+	return 4
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/godra-y/go-project/pkg/api/validator"
+)
+
+// withPolicy sets the password policy for the rest of the test.
+func withPolicy(t *testing.T, policy PasswordPolicy) {
+	t.Helper()
+
+	old := passwordPolicy
+	t.Cleanup(func() { passwordPolicy = old })
+
+	if err := SetPasswordPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "00000.txt")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		policy  PasswordPolicy
+		wantErr bool
+	}{
+		{"defaults", PasswordPolicy{MinLength: 8}, false},
+		{"strictest", PasswordPolicy{MinLength: 72, MinScore: 4, BreachedDir: dir}, false},
+		{"zero length", PasswordPolicy{MinLength: 0}, true},
+		{"longer than bcrypt allows", PasswordPolicy{MinLength: 73}, true},
+		{"negative score", PasswordPolicy{MinLength: 8, MinScore: -1}, true},
+		{"score too high", PasswordPolicy{MinLength: 8, MinScore: 5}, true},
+		{"missing directory", PasswordPolicy{MinLength: 8, BreachedDir: filepath.Join(dir, "missing")}, true},
+		{"file not directory", PasswordPolicy{MinLength: 8, BreachedDir: file}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := passwordPolicy
+			defer func() { passwordPolicy = old }()
+
+			err := SetPasswordPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePasswordPlaintext(t *testing.T) {
+	// A strict policy must not stop anyone logging in with an old password.
+	withPolicy(t, PasswordPolicy{MinLength: 16, MinScore: 4})
+
+	tests := []struct {
+		name     string
+		password string
+		valid    bool
+	}{
+		{"empty", "", false},
+		{"one byte", "a", true},
+		{"shorter than the minimum", "pa55word", true},
+		{"72 bytes", strings.Repeat("a", 72), true},
+		{"73 bytes", strings.Repeat("a", 73), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidatePasswordPlaintext(v, tt.password)
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateNewPassword(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+	err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Peter Parker", Email: "spidey@example.com"}
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		user     *User
+		valid    bool
+	}{
+		{"acceptable", PasswordPolicy{MinLength: 8}, "kT9#vq2Lm!", user, true},
+		{"empty", PasswordPolicy{MinLength: 8}, "", user, false},
+		{"too short", PasswordPolicy{MinLength: 8}, "kT9#vq2", user, false},
+		{"raised minimum", PasswordPolicy{MinLength: 12}, "kT9#vq2Lm!", user, false},
+		{"too long", PasswordPolicy{MinLength: 8}, strings.Repeat("kT9#", 19), user, false},
+		{"contains email", PasswordPolicy{MinLength: 8}, "my-SPIDEY-pass", user, false},
+		{"contains name", PasswordPolicy{MinLength: 8}, "parker#4821x", user, false},
+		{"no user", PasswordPolicy{MinLength: 8}, "parker#4821x", nil, true},
+		{"too easy", PasswordPolicy{MinLength: 8, MinScore: 3}, "marvel2024", user, false},
+		{"easy enough", PasswordPolicy{MinLength: 8, MinScore: 2}, "marvel2024", user, true},
+		{"breached", PasswordPolicy{MinLength: 8, BreachedDir: dir}, "password", nil, false},
+		{"not breached", PasswordPolicy{MinLength: 8, BreachedDir: dir}, "kT9#vq2Lm!", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPolicy(t, tt.policy)
+
+			v := validator.New()
+			ValidateNewPassword(v, tt.password, tt.user)
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t (%v); want %t", v.Valid(), v.Errors, tt.valid)
+			}
+		})
+	}
+}
+
+func TestPasswordScore(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"aaaaaaaa", 0},
+		{"abcdefgh", 0},
+		{"12345678", 0},
+		{"password", 0},
+		{"P@ssw0rd", 0},
+		{"xkq7", 2},
+		{"marvel2024", 2},
+		{"kT9#vq2Lm!", 4},
+		{"correct horse battery staple", 4},
+	}
+
+	for _, tt := range tests {
+		if got := passwordScore(tt.password); got != tt.want {
+			t.Errorf("%q: got %d; want %d", tt.password, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so the tests don't spend their time hashing.
+var (
+	testBcrypt   = BcryptHasher{Cost: bcrypt.MinCost}
+	testArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+)
+
+// withHasher sets the password hasher for the rest of the test.
+func withHasher(t *testing.T, h PasswordHasher) {
+	t.Helper()
+
+	old := passwordHasher
+	t.Cleanup(func() { passwordHasher = old })
+
+	SetPasswordHasher(h)
+}
+
+func TestPasswordMatches(t *testing.T) {
+	hashers := []struct {
+		name   string
+		hasher PasswordHasher
+	}{
+		{"bcrypt", testBcrypt},
+		{"argon2id", testArgon2id},
+	}
+
+	for _, h := range hashers {
+		t.Run(h.name, func(t *testing.T) {
+			withHasher(t, h.hasher)
+
+			var p password
+			if err := p.Set("kT9#vq2Lm!"); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				plaintext string
+				want      bool
+			}{
+				{"kT9#vq2Lm!", true},
+				{"kt9#vq2lm!", false},
+				{"kT9#vq2Lm", false},
+				{"", false},
+			}
+
+			for _, tt := range tests {
+				got, err := p.Matches(tt.plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("%q: got %t; want %t", tt.plaintext, got, tt.want)
+				}
+			}
+
+			if p.NeedsRehash() {
+				t.Error("fresh hash needs rehashing")
+			}
+		})
+	}
+}
+
+func TestPasswordChangedHasher(t *testing.T) {
+	withHasher(t, testBcrypt)
+
+	var p password
+	if err := p.Set("kT9#vq2Lm!"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		hasher      PasswordHasher
+		needsRehash bool
+	}{
+		{"same hasher", testBcrypt, false},
+		{"higher cost", BcryptHasher{Cost: bcrypt.MinCost + 1}, true},
+		{"argon2id", testArgon2id, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withHasher(t, tt.hasher)
+
+			match, err := p.Matches("kT9#vq2Lm!")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !match {
+				t.Error("old hash no longer matches")
+			}
+
+			if got := p.NeedsRehash(); got != tt.needsRehash {
+				t.Errorf("got NeedsRehash %t; want %t", got, tt.needsRehash)
+			}
+		})
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hash, err := testArgon2id.Hash("kT9#vq2Lm!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := func(f func(h *Argon2idHasher)) Argon2idHasher {
+		h := testArgon2id
+		f(&h)
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		hasher Argon2idHasher
+		want   bool
+	}{
+		{"same parameters", testArgon2id, false},
+		{"memory", changed(func(h *Argon2idHasher) { h.Memory = 128 }), true},
+		{"iterations", changed(func(h *Argon2idHasher) { h.Iterations = 2 }), true},
+		{"parallelism", changed(func(h *Argon2idHasher) { h.Parallelism = 2 }), true},
+		{"salt length", changed(func(h *Argon2idHasher) { h.SaltLength = 8 }), true},
+		{"key length", changed(func(h *Argon2idHasher) { h.KeyLength = 16 }), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(hash); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2id(t *testing.T) {
+	hash, err := testArgon2id.Hash("kT9#vq2Lm!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(string(hash), "$")
+
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"valid", string(hash), false},
+		{"bcrypt", "$2a$04$abcdefghijklmnopqrstuv", true},
+		{"too few parts", strings.Join(parts[:5], "$"), true},
+		{"other version", strings.Replace(string(hash), "v=19", "v=16", 1), true},
+		{"bad parameters", strings.Replace(string(hash), parts[3], "m=x,t=1,p=1", 1), true},
+		{"bad salt", strings.Replace(string(hash), parts[4], "!!", 1), true},
+		{"bad key", strings.Replace(string(hash), parts[5], "!!", 1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := decodeArgon2id([]byte(tt.hash))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
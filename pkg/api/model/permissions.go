@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"github.com/lib/pq"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -22,12 +22,15 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := startSpan(ctx, "PermissionModel.GetAllForUser")
+	defer span.End()
+
 	query := `
 		SELECT permissions.code
 		FROM permissions
@@ -36,7 +39,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		WHERE users.id = $1
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -45,7 +48,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			m.ErrorLog.Println(err)
+			m.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -69,13 +72,16 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := startSpan(ctx, "PermissionModel.AddForUser")
+	defer span.End()
+
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
@@ -5,25 +5,28 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/godra-y/go-project/pkg/api/validator"
-	"log"
+	"log/slog"
 	"time"
 )
 
 type Product struct {
 	ID          int     `json:"id"`
-	Title       string  `json:"title"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	Title       string  `json:"title" validate:"required,max=100"`
+	Description string  `json:"description" validate:"max=1000"`
+	Price       float64 `json:"price" validate:"min=0"`
 	CategoryID  int     `json:"category_id"`
 }
 
 type ProductModel struct {
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
 }
 
-func (pm ProductModel) GetAll(title string, price int, id int, filters Filters) ([]*Product, Metadata, error) {
+func (pm ProductModel) GetAll(ctx context.Context, title string, price int, id int, filters Filters) ([]*Product, Metadata, error) {
+	ctx, span := startSpan(ctx, "ProductModel.GetAll")
+	defer span.End()
+
 	query := fmt.Sprintf(
 		`
 		SELECT count(*) OVER(), id, title, description, price, category_id
@@ -34,7 +37,7 @@ func (pm ProductModel) GetAll(title string, price int, id int, filters Filters)
 		`,
 		filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{title, filters.limit(), filters.offset()}
@@ -45,7 +48,7 @@ func (pm ProductModel) GetAll(title string, price int, id int, filters Filters)
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			pm.ErrorLog.Println(err)
+			pm.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -70,7 +73,10 @@ func (pm ProductModel) GetAll(title string, price int, id int, filters Filters)
 	return products, metadata, nil
 }
 
-func (pm ProductModel) Insert(product *Product) error {
+func (pm ProductModel) Insert(ctx context.Context, product *Product) error {
+	ctx, span := startSpan(ctx, "ProductModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO products (title, description, price, category_id) 
 		VALUES ($1, $2, $3, $4) 
@@ -78,13 +84,16 @@ func (pm ProductModel) Insert(product *Product) error {
 		`
 
 	args := []interface{}{product.Title, product.Description, product.Price, product.CategoryID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	return pm.DB.QueryRowContext(ctx, query, args...).Scan(&product.ID)
 }
 
-func (pm ProductModel) Get(id int) (*Product, error) {
+func (pm ProductModel) Get(ctx context.Context, id int) (*Product, error) {
+	ctx, span := startSpan(ctx, "ProductModel.Get")
+	defer span.End()
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -96,7 +105,7 @@ func (pm ProductModel) Get(id int) (*Product, error) {
 		`
 
 	var product Product
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	row := pm.DB.QueryRowContext(ctx, query, id)
@@ -107,7 +116,10 @@ func (pm ProductModel) Get(id int) (*Product, error) {
 	return &product, nil
 }
 
-func (pm ProductModel) GetProductsByCategory(categoryID int, title string, filters Filters) ([]*Product, Metadata, error) {
+func (pm ProductModel) GetProductsByCategory(ctx context.Context, categoryID int, title string, filters Filters) ([]*Product, Metadata, error) {
+	ctx, span := startSpan(ctx, "ProductModel.GetProductsByCategory")
+	defer span.End()
+
 	query := fmt.Sprintf(
 		`
 		SELECT count(*) OVER(), id, title, description, price, category_id
@@ -118,7 +130,7 @@ func (pm ProductModel) GetProductsByCategory(categoryID int, title string, filte
 		`,
 		filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	args := []interface{}{categoryID, title, filters.limit(), filters.offset()}
@@ -129,7 +141,7 @@ func (pm ProductModel) GetProductsByCategory(categoryID int, title string, filte
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			pm.ErrorLog.Println(err)
+			pm.Logger.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}()
 
@@ -154,7 +166,10 @@ func (pm ProductModel) GetProductsByCategory(categoryID int, title string, filte
 	return products, metadata, nil
 }
 
-func (pm ProductModel) Update(product *Product) error {
+func (pm ProductModel) Update(ctx context.Context, product *Product) error {
+	ctx, span := startSpan(ctx, "ProductModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE products
 		SET title = $1, description = $2, price = $3, category_id = $4
@@ -163,13 +178,16 @@ func (pm ProductModel) Update(product *Product) error {
 		`
 
 	args := []interface{}{product.Title, product.Description, product.Price, product.CategoryID, product.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	return pm.DB.QueryRowContext(ctx, query, args...).Scan(&product.ID)
 }
 
-func (pm ProductModel) Delete(id int) error {
+func (pm ProductModel) Delete(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "ProductModel.Delete")
+	defer span.End()
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -178,7 +196,7 @@ func (pm ProductModel) Delete(id int) error {
 		DELETE FROM products
 		WHERE id = $1
 		`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, pm.QueryTimeout)
 	defer cancel()
 
 	_, err := pm.DB.ExecContext(ctx, query, id)
@@ -186,8 +204,5 @@ func (pm ProductModel) Delete(id int) error {
 }
 
 func ValidateProduct(v *validator.Validator, product *Product) {
-	v.Check(product.Title != "", "title", "must be provided")
-	v.Check(len(product.Title) <= 100, "title", "must not be more than 100 bytes long")
-	v.Check(len(product.Description) <= 1000, "description", "must not be more than 1000 bytes long")
-	v.Check(product.Price >= 0, "price", "must be a non-negative value")
+	v.Struct(product)
 }
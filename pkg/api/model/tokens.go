@@ -6,14 +6,21 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"github.com/godra-y/go-project/pkg/api/validator"
-	"log"
+	"log/slog"
 	"time"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "2fa_pending"
+	ScopeEmailChange    = "email-change"
+	ScopeImpersonation  = "impersonation"
 )
 
 type (
@@ -23,54 +30,367 @@ type (
 		UserID    int64     `json:"-"`
 		Expiry    time.Time `json:"expiry"`
 		Scope     string    `json:"-"`
+		UserAgent string    `json:"-"`
+
+		// Family links an access token to the refresh token it was issued
+		// with, and to every pair rotated from them since.
+		Family []byte     `json:"-"`
+		UsedAt *time.Time `json:"-"`
+
+		// ImpersonatorID is the staff user an impersonation token was issued
+		// to. The token itself acts as UserID.
+		ImpersonatorID *int64 `json:"-"`
+	}
+
+	// Session describes an authentication token without exposing it, for
+	// showing a user where they are signed in.
+	Session struct {
+		ID         string     `json:"id"`
+		Hash       []byte     `json:"-"`
+		Family     []byte     `json:"-"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		Expiry     time.Time  `json:"expiry"`
+		UserAgent  string     `json:"user_agent"`
+		Current    bool       `json:"current"`
 	}
 
 	TokenModel struct {
-		DB       *sql.DB
-		InfoLog  *log.Logger
-		ErrorLog *log.Logger
+		DB           *sql.DB
+		QueryTimeout time.Duration
+		Logger       *slog.Logger
 	}
 )
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.New")
+	defer span.End()
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+
+}
+
+// NewPair issues an authentication token and a refresh token in the same
+// family. A nil family starts a new one, as happens on login.
+func (m TokenModel) NewPair(ctx context.Context, userID int64, accessTTL, refreshTTL time.Duration, userAgent string, family []byte) (*Token, *Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.NewPair")
+	defer span.End()
+
+	access, err := m.NewInFamily(ctx, userID, accessTTL, ScopeAuthentication, userAgent, family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := m.NewInFamily(ctx, userID, refreshTTL, ScopeRefresh, userAgent, access.Family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// NewInFamily is like New but adds the token to a token family, starting a
+// new family if family is nil.
+func (m TokenModel) NewInFamily(ctx context.Context, userID int64, ttl time.Duration, scope, userAgent string, family []byte) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.NewInFamily")
+	defer span.End()
+
+	if family == nil {
+		family = make([]byte, 16)
+		if _, err := rand.Read(family); err != nil {
+			return nil, err
+		}
+	}
+
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	token.UserAgent = userAgent
+	token.Family = family
+
+	err = m.Insert(ctx, token)
 	return token, err
+}
+
+// NewImpersonation issues a token that acts as userID on behalf of the staff
+// user impersonatorID.
+func (m TokenModel) NewImpersonation(ctx context.Context, userID, impersonatorID int64, ttl time.Duration, userAgent string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.NewImpersonation")
+	defer span.End()
+
+	token, err := generateToken(userID, ttl, ScopeImpersonation)
+	if err != nil {
+		return nil, err
+	}
+
+	token.UserAgent = userAgent
+	token.ImpersonatorID = &impersonatorID
 
+	err = m.Insert(ctx, token)
+	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := startSpan(ctx, "TokenModel.Insert")
+	defer span.End()
+
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, family, impersonator_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.Family, token.ImpersonatorID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteAllForUser")
+	defer span.End()
+
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2
 		`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
 
+// RevokeAllForUser deletes every token belonging to a user, whatever its
+// scope, along with any impersonation tokens the user has been issued.
+func (m TokenModel) RevokeAllForUser(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "TokenModel.RevokeAllForUser")
+	defer span.End()
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 OR impersonator_id = $1
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Get returns the unexpired token of the given scope with a matching
+// plaintext, whether or not it has been used.
+func (m TokenModel) Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	ctx, span := startSpan(ctx, "TokenModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT hash, user_id, expiry, scope, user_agent, family, used_at, impersonator_id
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		`
+
+	token := Token{Plaintext: tokenPlaintext}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, HashToken(tokenPlaintext), scope, time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.UserAgent,
+		&token.Family,
+		&token.UsedAt,
+		&token.ImpersonatorID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// MarkUsed flags a token as used. It returns false if the token had already
+// been used, which for refresh tokens means it is being replayed.
+func (m TokenModel) MarkUsed(ctx context.Context, hash []byte) (bool, error) {
+	ctx, span := startSpan(ctx, "TokenModel.MarkUsed")
+	defer span.End()
+
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = $1 AND used_at IS NULL
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hash)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// DeleteFamily removes every token in a family. Passing a scope limits the
+// deletion to tokens of that scope.
+func (m TokenModel) DeleteFamily(ctx context.Context, family []byte, scope string) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteFamily")
+	defer span.End()
+
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1 AND (scope = $2 OR $2 = '')
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family, scope)
+	return err
+}
+
+// DeleteSession removes a token along with the rest of its family, so that
+// signing out also invalidates the refresh token.
+func (m TokenModel) DeleteSession(ctx context.Context, hash []byte) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteSession")
+	defer span.End()
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+			OR family = (SELECT family FROM tokens WHERE hash = $1)
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+// DeleteOtherSessions removes a user's authentication and refresh tokens
+// except those belonging to the session identified by hash (an opaque access
+// token) or family (a JWT session). Either may be nil.
+func (m TokenModel) DeleteOtherSessions(ctx context.Context, userID int64, hash, family []byte) error {
+	ctx, span := startSpan(ctx, "TokenModel.DeleteOtherSessions")
+	defer span.End()
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1
+			AND scope IN ($2, $3)
+			AND hash <> COALESCE($4, ''::bytea)
+			AND family IS DISTINCT FROM COALESCE($5, (SELECT family FROM tokens WHERE hash = $4))
+		`
+
+	args := []interface{}{userID, ScopeAuthentication, ScopeRefresh, hash, family}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Touch records that a token has just been used. To avoid a write on every
+// request the timestamp is only moved forward once a minute.
+func (m TokenModel) Touch(ctx context.Context, hash []byte) error {
+	ctx, span := startSpan(ctx, "TokenModel.Touch")
+	defer span.End()
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1
+			AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+// GetAllForUser returns the unexpired, unused tokens of the given scope
+// belonging to a user, newest first.
+func (m TokenModel) GetAllForUser(ctx context.Context, scope string, userID int64) ([]*Session, error) {
+	ctx, span := startSpan(ctx, "TokenModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT hash, family, created_at, last_used_at, expiry, user_agent
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL
+		ORDER BY created_at DESC
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.Logger.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(&session.Hash, &session.Family, &session.CreatedAt, &session.LastUsedAt, &session.Expiry, &session.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		session.ID = hex.EncodeToString(session.Hash[:8])
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// HashToken returns the hash under which a token's plaintext is stored.
+func HashToken(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
@@ -87,8 +407,7 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashToken(token.Plaintext)
 
 	return token, nil
 }
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+// TwoFactor is a user's TOTP enrollment. Secret is set when enrollment
+// starts; Enabled only once the user has proved they can generate codes.
+type TwoFactor struct {
+	UserID       int64
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+type TwoFactorModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
+}
+
+func (m TwoFactorModel) Get(ctx context.Context, userID int64) (*TwoFactor, error) {
+	ctx, span := startSpan(ctx, "TwoFactorModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT user_id, secret, enabled, last_used_step
+		FROM two_factor
+		WHERE user_id = $1
+		`
+
+	var tf TwoFactor
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.UserID, &tf.Secret, &tf.Enabled, &tf.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &tf, nil
+}
+
+// Begin stores a new, not yet enabled secret for the user, replacing any
+// earlier enrollment that was never completed.
+func (m TwoFactorModel) Begin(ctx context.Context, userID int64, secret string) error {
+	ctx, span := startSpan(ctx, "TwoFactorModel.Begin")
+	defer span.End()
+
+	query := `
+		INSERT INTO two_factor (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = $2, last_used_step = 0, created_at = NOW()
+		WHERE two_factor.enabled = FALSE
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+// Enable turns on two-factor authentication and replaces the user's
+// recovery codes, returning the new codes in plaintext. They are only
+// stored hashed, so this is the one chance to show them.
+func (m TwoFactorModel) Enable(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := startSpan(ctx, "TwoFactorModel.Enable")
+	defer span.End()
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE two_factor SET enabled = TRUE WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, HashToken(code), userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+func (m TwoFactorModel) Disable(ctx context.Context, userID int64) error {
+	ctx, span := startSpan(ctx, "TwoFactorModel.Disable")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM two_factor WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that the code for a time step has been used. It returns
+// false if that step, or a later one, was already used.
+func (m TwoFactorModel) UseStep(ctx context.Context, userID, step int64) (bool, error) {
+	ctx, span := startSpan(ctx, "TwoFactorModel.UseStep")
+	defer span.End()
+
+	query := `
+		UPDATE two_factor
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// UseRecoveryCode consumes a recovery code, returning false if the user has
+// no such unused code.
+func (m TwoFactorModel) UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	ctx, span := startSpan(ctx, "TwoFactorModel.UseRecoveryCode")
+	defer span.End()
+
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND hash = $2
+		`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	result, err := m.DB.ExecContext(ctx, query, userID, HashToken(code))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// generateRecoveryCode returns a code such as "k3j9d-x2mfq".
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
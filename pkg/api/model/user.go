@@ -2,12 +2,12 @@ package model
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/godra-y/go-project/pkg/api/validator"
-	"golang.org/x/crypto/bcrypt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 )
 
@@ -17,14 +17,22 @@ var (
 
 var AnonymousUser = &User{}
 
+// likeEscaper escapes the LIKE wildcards in user input, so that searching for
+// "a_b" doesn't also match "axb". It pairs with ESCAPE '\' in the query.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// User is an account. Activated records that the email address has been
+// verified; Deactivated is set by an administrator and locks the user out
+// regardless of it.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Password    password  `json:"-"`
+	Activated   bool      `json:"activated"`
+	Deactivated bool      `json:"deactivated"`
+	Version     int       `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -32,42 +40,15 @@ func (u *User) IsAnonymous() bool {
 }
 
 type UserModel struct {
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
-}
-
-type password struct {
-	plaintext *string
-	hash      []byte
+	DB           *sql.DB
+	QueryTimeout time.Duration
+	Logger       *slog.Logger
 }
 
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
-	if err != nil {
-		return err
-	}
-
-	p.plaintext = &plaintextPassword
-	p.hash = hash
-	return nil
-}
-
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-
-	return true, nil
-}
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Insert")
+	defer span.End()
 
-func (m UserModel) Insert(user *User) error {
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -76,7 +57,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	pqErr := `pq: duplicate key value violates unique constraint "users_email_key"`
@@ -93,16 +74,126 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.Get")
+	defer span.End()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, deactivated, version
+		FROM users
+		WHERE id = $1
+		`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetAll returns users whose email or name contains the given text, matched
+// case-insensitively. Empty strings and nil flags match everyone.
+func (m UserModel) GetAll(ctx context.Context, email, name string, activated, deactivated *bool, filters Filters) ([]*User, Metadata, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetAll")
+	defer span.End()
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, deactivated, version
+		FROM users
+		WHERE (email ILIKE '%%' || $1 || '%%' ESCAPE '\' OR $1 = '')
+			AND (name ILIKE '%%' || $2 || '%%' ESCAPE '\' OR $2 = '')
+			AND (activated = $3 OR $3 IS NULL)
+			AND (deactivated = $4 OR $4 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $5 OFFSET $6
+		`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	args := []interface{}{likeEscaper.Replace(email), likeEscaper.Replace(name), activated, deactivated, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			m.Logger.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Deactivated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetByEmail")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, deactivated, version
 		FROM users
 		WHERE email = $1
 		`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -112,6 +203,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
 	)
 
@@ -127,11 +219,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, deactivated = $5, version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version
 		`
 
@@ -140,11 +235,12 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Deactivated,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -162,12 +258,75 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+// Anonymize closes a user's account. The row is kept so that anything which
+// refers to it stays consistent, but the name and email are replaced, the
+// password is replaced by the one already set on user, and every credential,
+// permission and pending change belonging to the account is deleted.
+func (m UserModel) Anonymize(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Anonymize")
+	defer span.End()
+
+	user.Name = "Deleted user"
+	user.Email = fmt.Sprintf("deleted-%d@users.invalid", user.ID)
+	user.Activated = false
+	user.Deactivated = true
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET name = $1, email = $2, password_hash = $3, activated = FALSE, deactivated = TRUE, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+		`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.ID, user.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	for _, table := range []string{
+		"tokens",
+		"api_keys",
+		"recovery_codes",
+		"two_factor",
+		"user_identities",
+		"login_lockouts",
+		"email_changes",
+		"users_permissions",
+	} {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = $1", user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetForToken")
+	defer span.End()
+
+	tokenHash := HashToken(tokenPlaintext)
 
 	query := `
 		SELECT users.id, users.created_at, users.name, users.email, 
-		       users.password_hash, users.activated, users.version
+		       users.password_hash, users.activated, users.deactivated, users.version
 		FROM users
         INNER JOIN tokens
 			ON users.id = tokens.user_id
@@ -176,11 +335,11 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			AND tokens.expiry > $3
 		`
 
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHash, tokenScope, time.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -190,6 +349,58 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetForSession returns the user with the given ID as long as the token
+// family still holds an unexpired refresh token, that is, the session
+// hasn't been signed out or revoked. It is how JWT access tokens, which
+// can't be deleted themselves, are checked.
+func (m UserModel) GetForSession(ctx context.Context, userID int64, family []byte) (*User, error) {
+	ctx, span := startSpan(ctx, "UserModel.GetForSession")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, deactivated, version
+		FROM users
+		WHERE id = $1
+			AND EXISTS (
+				SELECT 1
+				FROM tokens
+				WHERE tokens.user_id = users.id
+					AND tokens.family = $2
+					AND tokens.scope = $3
+					AND tokens.expiry > $4
+			)
+		`
+
+	args := []interface{}{userID, family, ScopeRefresh, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
 	)
 	if err != nil {
@@ -209,12 +420,6 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
-}
-
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
@@ -222,7 +427,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext, user)
 	}
 
 	if user.Password.hash == nil {
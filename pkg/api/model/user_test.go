@@ -0,0 +1,23 @@
+package model
+
+import "testing"
+
+func TestLikeEscaper(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"peter@example.com", "peter@example.com"},
+		{"peter_parker", `peter\_parker`},
+		{"100%", `100\%`},
+		{`back\slash`, `back\\slash`},
+		{`%_\`, `\%\_\\`},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := likeEscaper.Replace(tt.in); got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rule checks a single field value against the parameter given in the
+// struct tag (the part after "=", empty if there is none). It returns false
+// and a message when the value is invalid.
+type Rule func(value reflect.Value, param string) (bool, string)
+
+// ruleCheck reports whether a rule can be applied to fields of the given
+// kind with the given parameter.
+type ruleCheck func(kind reflect.Kind, param string) error
+
+var (
+	rulesMu sync.RWMutex
+	rules   = map[string]Rule{
+		"required": required,
+		"max":      maxRule,
+		"min":      minRule,
+		"gt":       gtRule,
+		"email":    email,
+		"oneof":    oneOf,
+		"unique":   unique,
+	}
+
+	// ruleChecks holds the checks of the built-in rules that can't be used
+	// on every field. Rules added with RegisterRule have none.
+	ruleChecks = map[string]ruleCheck{
+		"max":    checkLength,
+		"min":    checkLength,
+		"gt":     checkNumber,
+		"email":  checkString,
+		"unique": checkList,
+	}
+)
+
+// RegisterRule makes a rule available to struct tags under the given name,
+// replacing any existing rule with that name.
+func RegisterRule(name string, rule Rule) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	rules[name] = rule
+	delete(ruleChecks, name)
+}
+
+func lookupRule(name string) (Rule, bool) {
+	rule, _, ok := lookupRuleCheck(name)
+	return rule, ok
+}
+
+func lookupRuleCheck(name string) (Rule, ruleCheck, bool) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	rule, ok := rules[name]
+	return rule, ruleChecks[name], ok
+}
+
+// required rejects zero values, and empty slices and maps. A string of
+// only spaces counts as provided, as it did before struct tags.
+func required(value reflect.Value, _ string) (bool, string) {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() > 0, "must be provided"
+	}
+
+	return !value.IsZero(), "must be provided"
+}
+
+func maxRule(value reflect.Value, param string) (bool, string) {
+	limit := paramFloat("max", param)
+
+	switch value.Kind() {
+	case reflect.String:
+		return float64(value.Len()) <= limit, fmt.Sprintf("must not be more than %s bytes long", param)
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()) <= limit, fmt.Sprintf("must not contain more than %s items", param)
+	}
+
+	return number(value) <= limit, fmt.Sprintf("must be a maximum of %s", param)
+}
+
+func minRule(value reflect.Value, param string) (bool, string) {
+	limit := paramFloat("min", param)
+
+	switch value.Kind() {
+	case reflect.String:
+		return float64(value.Len()) >= limit, fmt.Sprintf("must be at least %s bytes long", param)
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()) >= limit, fmt.Sprintf("must contain at least %s items", param)
+	}
+
+	if limit == 0 {
+		return number(value) >= 0, "must be a non-negative value"
+	}
+
+	return number(value) >= limit, fmt.Sprintf("must be at least %s", param)
+}
+
+func gtRule(value reflect.Value, param string) (bool, string) {
+	limit := paramFloat("gt", param)
+
+	if limit == 0 {
+		return number(value) > 0, "must be a positive value"
+	}
+
+	return number(value) > limit, fmt.Sprintf("must be greater than %s", param)
+}
+
+func email(value reflect.Value, _ string) (bool, string) {
+	return Matches(value.String(), EmailRX), "must be valid email address"
+}
+
+func oneOf(value reflect.Value, param string) (bool, string) {
+	list := strings.Fields(param)
+	message := fmt.Sprintf("must be one of %s", strings.Join(list, ", "))
+
+	if value.Kind() == reflect.String {
+		return In(value.String(), list...), message
+	}
+
+	return In(fmt.Sprint(value.Interface()), list...), message
+}
+
+func unique(value reflect.Value, _ string) (bool, string) {
+	values := make([]string, value.Len())
+	for i := range values {
+		values[i] = fmt.Sprint(value.Index(i).Interface())
+	}
+
+	return Unique(values), "must not contain duplicate values"
+}
+
+func checkLength(kind reflect.Kind, param string) error {
+	switch kind {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return checkParam(param)
+	}
+
+	return checkNumber(kind, param)
+}
+
+func checkNumber(kind reflect.Kind, param string) error {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return checkParam(param)
+	}
+
+	return fmt.Errorf("can't be used on a %s", kind)
+}
+
+func checkString(kind reflect.Kind, _ string) error {
+	if kind != reflect.String {
+		return fmt.Errorf("can't be used on a %s", kind)
+	}
+	return nil
+}
+
+func checkList(kind reflect.Kind, _ string) error {
+	if kind != reflect.Slice && kind != reflect.Array {
+		return fmt.Errorf("can't be used on a %s", kind)
+	}
+	return nil
+}
+
+func checkParam(param string) error {
+	if _, err := strconv.ParseFloat(param, 64); err != nil {
+		return fmt.Errorf("invalid parameter %q", param)
+	}
+	return nil
+}
+
+func number(value reflect.Value) float64 {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	}
+
+	panic("validator: numeric rule used on non-numeric kind " + value.Kind().String())
+}
+
+func paramFloat(rule, param string) float64 {
+	f, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validator: invalid parameter %q for rule %q", param, rule))
+	}
+
+	return f
+}
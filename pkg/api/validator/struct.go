@@ -0,0 +1,279 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const tagName = "validate"
+
+// checked holds the struct types whose tags have been checked and found
+// valid.
+var checked sync.Map
+
+// Register checks the `validate` tags of the given structs' types, such as
+// Register(Product{}), so that an unknown rule, a bad parameter or a rule
+// that can't apply to its field is reported when the program starts instead
+// of when a request is validated. Rules added with RegisterRule must be
+// registered before the types that use them.
+func Register(values ...interface{}) error {
+	for _, value := range values {
+		if err := checkType(reflect.TypeOf(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustRegister is like Register but panics if a tag is invalid. It is meant
+// to be called from init functions.
+func MustRegister(values ...interface{}) {
+	if err := Register(values...); err != nil {
+		panic(err)
+	}
+}
+
+// Struct validates s using the `validate` struct tags on its fields, for
+// example `validate:"required,max=100"`. Nested structs and slices of structs
+// are walked recursively and their errors are keyed by path, such as
+// "items[2].quantity". Field names are taken from the json tag when present.
+func (v *Validator) Struct(s interface{}) {
+	value := reflect.ValueOf(s)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		panic("validator: Struct called with non-struct type " + value.Type().String())
+	}
+
+	// Types that weren't registered are checked the first time they are
+	// seen, so a bad tag fails every time rather than only for some values.
+	if err := checkType(value.Type()); err != nil {
+		panic(err)
+	}
+
+	v.walkStruct(value, "")
+}
+
+func checkType(t reflect.Type) error {
+	if t == nil {
+		return errors.New("validator: Register called with nil")
+	}
+
+	t = indirectType(t)
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("validator: %s is not a struct type", t)
+	}
+
+	if _, ok := checked.Load(t); ok {
+		return nil
+	}
+
+	if err := checkStruct(t, t.String()+".", make(map[reflect.Type]bool)); err != nil {
+		return err
+	}
+
+	checked.Store(t, true)
+	return nil
+}
+
+// checkStruct checks the tags of t's fields the way walkStruct visits them.
+func checkStruct(t reflect.Type, prefix string, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fieldType := indirectType(field.Type)
+
+		if field.Anonymous && fieldType.Kind() == reflect.Struct {
+			if err := checkStruct(fieldType, prefix, seen); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := field.Tag.Get(tagName)
+		if fieldName(field) == "" || tag == "-" {
+			continue
+		}
+
+		if err := checkRules(fieldType.Kind(), tag); err != nil {
+			return fmt.Errorf("validator: field %s%s: %w", prefix, field.Name, err)
+		}
+
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			if err := checkStruct(fieldType, prefix+field.Name+".", seen); err != nil {
+				return err
+			}
+		case reflect.Slice, reflect.Array:
+			if elem := indirectType(fieldType.Elem()); elem.Kind() == reflect.Struct {
+				if err := checkStruct(elem, prefix+field.Name+"[].", seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkRules(kind reflect.Kind, tag string) error {
+	for _, part := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+
+		_, check, ok := lookupRuleCheck(name)
+		if !ok {
+			return fmt.Errorf("unknown rule %q", name)
+		}
+
+		// An interface field's kind is only known from its value.
+		if check == nil || kind == reflect.Interface {
+			continue
+		}
+
+		if err := check(kind, param); err != nil {
+			return fmt.Errorf("rule %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (v *Validator) walkStruct(value reflect.Value, prefix string) {
+	t := value.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+
+		if field.Anonymous && indirectType(field.Type).Kind() == reflect.Struct {
+			if fv, ok := indirect(fieldValue); ok {
+				v.walkStruct(fv, prefix)
+			}
+			continue
+		}
+
+		name := fieldName(field)
+		if name == "" {
+			continue
+		}
+
+		v.walkField(fieldValue, prefix+name, field.Tag.Get(tagName))
+	}
+}
+
+func (v *Validator) walkField(value reflect.Value, key, tag string) {
+	if tag == "-" {
+		return
+	}
+
+	fv, ok := indirect(value)
+	if !ok {
+		if hasRule(tag, "required") {
+			v.AddError(key, "must be provided")
+		}
+		return
+	}
+
+	if tag != "" {
+		v.applyRules(fv, key, tag)
+	}
+
+	switch fv.Kind() {
+	case reflect.Struct:
+		v.walkStruct(fv, key+".")
+	case reflect.Slice, reflect.Array:
+		if indirectType(fv.Type().Elem()).Kind() != reflect.Struct {
+			return
+		}
+		for i := 0; i < fv.Len(); i++ {
+			if elem, ok := indirect(fv.Index(i)); ok {
+				v.walkStruct(elem, fmt.Sprintf("%s[%d].", key, i))
+			}
+		}
+	}
+}
+
+func (v *Validator) applyRules(value reflect.Value, key, tag string) {
+	for _, part := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+
+		rule, ok := lookupRule(name)
+		if !ok {
+			panic("validator: unknown rule " + name)
+		}
+
+		if ok, message := rule(value, param); !ok {
+			v.AddError(key, message)
+
+			// Nothing else is meaningful for a value that is missing.
+			if name == "required" {
+				return
+			}
+		}
+	}
+}
+
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+
+	return name
+}
+
+func hasRule(tag, name string) bool {
+	for _, part := range strings.Split(tag, ",") {
+		if rule, _, _ := strings.Cut(strings.TrimSpace(part), "="); rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+func indirect(value reflect.Value) (reflect.Value, bool) {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return value, false
+		}
+		value = value.Elem()
+	}
+	return value, true
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
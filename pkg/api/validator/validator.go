@@ -8,12 +8,19 @@ var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// Validator collects validation errors. Errors holds the first message for
+// each key, while Messages keeps every message recorded for the key in the
+// order they were added; problem documents report all of them.
 type Validator struct {
-	Errors map[string]string
+	Errors   map[string]string
+	Messages map[string][]string
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{
+		Errors:   make(map[string]string),
+		Messages: make(map[string][]string),
+	}
 }
 
 func (v *Validator) Valid() bool {
@@ -24,6 +31,17 @@ func (v *Validator) AddError(key, message string) {
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
 	}
+
+	if v.Messages == nil {
+		v.Messages = make(map[string][]string)
+	}
+
+	for _, m := range v.Messages[key] {
+		if m == message {
+			return
+		}
+	}
+	v.Messages[key] = append(v.Messages[key], message)
 }
 
 func (v *Validator) Check(ok bool, key, message string) {
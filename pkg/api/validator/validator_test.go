@@ -0,0 +1,344 @@
+package validator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type item struct {
+	ProductID int64 `json:"product_id" validate:"gt=0"`
+	Quantity  int   `json:"quantity" validate:"gt=0,max=100"`
+}
+
+type address struct {
+	City string `json:"city" validate:"required"`
+}
+
+type order struct {
+	Email    string   `json:"email" validate:"required,email"`
+	Name     string   `json:"name" validate:"required,max=5"`
+	Status   string   `json:"status" validate:"oneof=new paid"`
+	Discount float64  `json:"discount" validate:"min=0,max=1"`
+	Tags     []string `json:"tags" validate:"max=2,unique"`
+	Note     *string  `json:"note" validate:"required"`
+	Address  address  `json:"address"`
+	Items    []item   `json:"items" validate:"required"`
+	Ignored  string   `json:"-" validate:"required"`
+	NoJSON   string   `validate:"max=1"`
+	internal string
+}
+
+func validOrder() order {
+	note := "leave at the door"
+	return order{
+		Email:    "alice@example.com",
+		Name:     "Alice",
+		Status:   "new",
+		Discount: 0.5,
+		Tags:     []string{"a", "b"},
+		Note:     &note,
+		Address:  address{City: "Almaty"},
+		Items:    []item{{ProductID: 1, Quantity: 1}},
+	}
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *order)
+		errors map[string]string
+	}{
+		{
+			name:   "valid",
+			modify: func(o *order) {},
+			errors: map[string]string{},
+		},
+		{
+			name:   "missing required string",
+			modify: func(o *order) { o.Email = "" },
+			errors: map[string]string{"email": "must be provided"},
+		},
+		{
+			name:   "blank required string",
+			modify: func(o *order) { o.Name = "  " },
+			errors: map[string]string{},
+		},
+		{
+			name:   "invalid email",
+			modify: func(o *order) { o.Email = "alice" },
+			errors: map[string]string{"email": "must be valid email address"},
+		},
+		{
+			name:   "string too long",
+			modify: func(o *order) { o.Name = "Alice Smith" },
+			errors: map[string]string{"name": "must not be more than 5 bytes long"},
+		},
+		{
+			name:   "not one of",
+			modify: func(o *order) { o.Status = "shipped" },
+			errors: map[string]string{"status": "must be one of new, paid"},
+		},
+		{
+			name:   "negative number",
+			modify: func(o *order) { o.Discount = -1 },
+			errors: map[string]string{"discount": "must be a non-negative value"},
+		},
+		{
+			name:   "number too large",
+			modify: func(o *order) { o.Discount = 2 },
+			errors: map[string]string{"discount": "must be a maximum of 1"},
+		},
+		{
+			name:   "too many items",
+			modify: func(o *order) { o.Tags = []string{"a", "b", "c"} },
+			errors: map[string]string{"tags": "must not contain more than 2 items"},
+		},
+		{
+			name:   "duplicates",
+			modify: func(o *order) { o.Tags = []string{"a", "a"} },
+			errors: map[string]string{"tags": "must not contain duplicate values"},
+		},
+		{
+			name:   "nil required pointer",
+			modify: func(o *order) { o.Note = nil },
+			errors: map[string]string{"note": "must be provided"},
+		},
+		{
+			name:   "nested struct",
+			modify: func(o *order) { o.Address.City = "" },
+			errors: map[string]string{"address.city": "must be provided"},
+		},
+		{
+			name:   "empty required slice",
+			modify: func(o *order) { o.Items = nil },
+			errors: map[string]string{"items": "must be provided"},
+		},
+		{
+			name: "slice of structs",
+			modify: func(o *order) {
+				o.Items = []item{{ProductID: 1, Quantity: 1}, {ProductID: 0, Quantity: 101}}
+			},
+			errors: map[string]string{
+				"items[1].product_id": "must be a positive value",
+				"items[1].quantity":   "must be a maximum of 100",
+			},
+		},
+		{
+			name:   "field without json tag",
+			modify: func(o *order) { o.NoJSON = "ab" },
+			errors: map[string]string{"NoJSON": "must not be more than 1 bytes long"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := validOrder()
+			tt.modify(&o)
+
+			v := New()
+			v.Struct(&o)
+
+			if !reflect.DeepEqual(v.Errors, tt.errors) {
+				t.Errorf("got errors %v; want %v", v.Errors, tt.errors)
+			}
+			if v.Valid() != (len(tt.errors) == 0) {
+				t.Errorf("got Valid() %t with errors %v", v.Valid(), v.Errors)
+			}
+		})
+	}
+}
+
+func TestStructNilPointer(t *testing.T) {
+	v := New()
+	v.Struct((*order)(nil))
+
+	if !v.Valid() {
+		t.Errorf("got errors %v for a nil pointer", v.Errors)
+	}
+}
+
+func TestStructRequiredStopsOtherRules(t *testing.T) {
+	var input struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	v := New()
+	v.Struct(input)
+
+	if got := v.Messages["email"]; !reflect.DeepEqual(got, []string{"must be provided"}) {
+		t.Errorf("got messages %q; want only the required message", got)
+	}
+}
+
+func TestStructMultipleMessages(t *testing.T) {
+	var input struct {
+		Code string `json:"code" validate:"min=4,email"`
+	}
+	input.Code = "ab"
+
+	v := New()
+	v.Struct(input)
+
+	want := []string{"must be at least 4 bytes long", "must be valid email address"}
+	if got := v.Messages["code"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %q; want %q", got, want)
+	}
+	if got := v.Errors["code"]; got != want[0] {
+		t.Errorf("got error %q; want the first message %q", got, want[0])
+	}
+}
+
+func TestRegisterRule(t *testing.T) {
+	RegisterRule("lowercase", func(value reflect.Value, _ string) (bool, string) {
+		return value.String() == strings.ToLower(value.String()), "must be lowercase"
+	})
+
+	var input struct {
+		Slug string `json:"slug" validate:"lowercase"`
+	}
+	input.Slug = "Marvel"
+
+	v := New()
+	v.Struct(input)
+
+	if got := v.Errors["slug"]; got != "must be lowercase" {
+		t.Errorf("got error %q; want %q", got, "must be lowercase")
+	}
+}
+
+func TestStructPanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		input interface{}
+	}{
+		{"non-struct", 42},
+		{"unknown rule", struct {
+			A string `validate:"nosuchrule"`
+		}{}},
+		{"bad parameter", struct {
+			A string `validate:"max=ten"`
+		}{}},
+		{"numeric rule on string", struct {
+			A string `validate:"gt=0"`
+		}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+
+			New().Struct(tt.input)
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	type nested struct {
+		Count string `validate:"min"`
+	}
+
+	tests := []struct {
+		name  string
+		input interface{}
+		want  string
+	}{
+		{"valid", order{}, ""},
+		{"pointer", &order{}, ""},
+		{"non-struct", 42, "not a struct type"},
+		{"unknown rule", struct {
+			A string `validate:"required,nosuchrule"`
+		}{}, `.A: unknown rule "nosuchrule"`},
+		{"bad parameter", struct {
+			A string `validate:"max=ten"`
+		}{}, `rule "max": invalid parameter "ten"`},
+		{"numeric rule on string", struct {
+			A string `validate:"gt=0"`
+		}{}, `rule "gt": can't be used on a string`},
+		{"email on int", struct {
+			A *int `validate:"email"`
+		}{}, `rule "email": can't be used on a int`},
+		{"unique on string", struct {
+			A string `validate:"unique"`
+		}{}, `rule "unique": can't be used on a string`},
+		{"nested slice", struct {
+			Items []nested
+		}{}, `.Items[].Count: rule "min": invalid parameter ""`},
+		{"ignored field", struct {
+			A string `json:"-" validate:"nosuchrule"`
+			B string `validate:"-"`
+		}{}, ""},
+		{"interface field", struct {
+			A interface{} `validate:"gt=0"`
+		}{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Register(tt.input)
+
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("got no error; want %q", tt.want)
+			case err != nil && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("got error %q; want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	v := New()
+	v.Check(true, "a", "not added")
+	v.Check(false, "b", "first")
+	v.Check(false, "b", "second")
+	v.Check(false, "b", "first")
+
+	if _, ok := v.Errors["a"]; ok {
+		t.Error("passing check added an error")
+	}
+	if got := v.Errors["b"]; got != "first" {
+		t.Errorf("got error %q; want %q", got, "first")
+	}
+	if got := v.Messages["b"]; !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("got messages %q; want [first second]", got)
+	}
+}
+
+func TestAddErrorZeroValue(t *testing.T) {
+	v := Validator{Errors: map[string]string{}}
+	v.AddError("a", "message")
+
+	if got := v.Messages["a"]; !reflect.DeepEqual(got, []string{"message"}) {
+		t.Errorf("got messages %q", got)
+	}
+}
+
+func TestHelpers(t *testing.T) {
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"in", In("b", "a", "b"), true},
+		{"not in", In("c", "a", "b"), false},
+		{"in empty", In("a"), false},
+		{"unique", Unique([]string{"a", "b"}), true},
+		{"not unique", Unique([]string{"a", "b", "a"}), false},
+		{"email", Matches("bob@mail.example.com", EmailRX), true},
+		{"email without domain", Matches("bob@", EmailRX), false},
+		{"email with space", Matches("bob smith@example.com", EmailRX), false},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.name, tt.got, tt.want)
+		}
+	}
+}
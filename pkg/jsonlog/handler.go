@@ -0,0 +1,200 @@
+package jsonlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// handler implements slog.Handler, and does the writing for Logger.
+type handler struct {
+	core   *core
+	groups []string
+	attrs  []boundAttr
+}
+
+// boundAttr is a field added with With or WithAttrs, along with the groups
+// open when it was added.
+type boundAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.enabled(fromSlog(level))
+}
+
+func (h *handler) enabled(level Level) bool {
+	return int32(level) >= h.core.minLevel.Load()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	return h.write(ctx, fromSlog(r.Level), t, r.Message, attrs)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.withAttrs(attrs)
+}
+
+func (h *handler) withAttrs(attrs []slog.Attr) *handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	h2 := *h
+	h2.attrs = make([]boundAttr, len(h.attrs), len(h.attrs)+len(attrs))
+	copy(h2.attrs, h.attrs)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, boundAttr{groups: h.groups, attr: a})
+	}
+	return &h2
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+type entry struct {
+	Level      string         `json:"level"`
+	Time       string         `json:"time"`
+	Message    string         `json:"message"`
+	Properties map[string]any `json:"properties,omitempty"`
+	Trace      string         `json:"trace,omitempty"`
+}
+
+func (h *handler) write(ctx context.Context, level Level, t time.Time, message string, attrs []slog.Attr) error {
+	if s := h.core.sampler.Load(); s != nil && level < LevelFatal && !s.allow(level, message) {
+		return nil
+	}
+
+	properties := make(map[string]any)
+
+	for _, b := range h.attrs {
+		addAttr(properties, b.groups, b.attr)
+	}
+
+	if fn := h.core.contextFields.Load(); fn != nil && ctx != nil {
+		for _, a := range (*fn)(ctx) {
+			addAttr(properties, nil, a)
+		}
+	}
+
+	for _, a := range attrs {
+		addAttr(properties, h.groups, a)
+	}
+
+	e := entry{
+		Level:      level.String(),
+		Time:       t.UTC().Format(time.RFC3339),
+		Message:    message,
+		Properties: properties,
+	}
+
+	if level >= LevelFatal {
+		e.Trace = stackTrace()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		e.Properties = map[string]any{"marshal_error": err.Error()}
+		line, _ = json.Marshal(e)
+	}
+
+	h.core.mu.Lock()
+	defer h.core.mu.Unlock()
+
+	_, err = h.core.out.Write(append(line, '\n'))
+	return err
+}
+
+// addAttr adds a to m within the given groups. As with slog's own
+// handlers, empty attributes and empty groups are left out, and a group
+// with an empty key is inlined.
+func addAttr(m map[string]any, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		members := a.Value.Group()
+		if len(members) == 0 {
+			return
+		}
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, member := range members {
+			addAttr(m, groups, member)
+		}
+		return
+	}
+
+	for _, g := range groups {
+		sub, ok := m[g].(map[string]any)
+		if !ok {
+			sub = make(map[string]any)
+			m[g] = sub
+		}
+		m = sub
+	}
+
+	m[a.Key] = jsonValue(a.Value)
+}
+
+// jsonValue converts v to a value that encodes well: durations and times
+// become strings, as do errors and floats JSON can't represent.
+func jsonValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindString:
+		return v.String()
+	case slog.KindInt64:
+		return v.Int64()
+	case slog.KindUint64:
+		return v.Uint64()
+	case slog.KindFloat64:
+		f := v.Float64()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return f
+	case slog.KindBool:
+		return v.Bool()
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	}
+
+	switch a := v.Any().(type) {
+	case error:
+		return a.Error()
+	case json.Marshaler:
+		return a
+	case fmt.Stringer:
+		return a.String()
+	default:
+		return a
+	}
+}
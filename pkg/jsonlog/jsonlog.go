@@ -1,97 +1,222 @@
 package jsonlog
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Level values match those of log/slog, so that they convert directly.
 type Level int8
 
 const (
-	LevelInfo Level = iota
-	LevelError
-	LevelFatal
-	LevelOff
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+	LevelFatal Level = 12
+	LevelOff   Level = 127
 )
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-type Logger struct {
+// ParseLevel parses a level name, such as "debug" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		return LevelDebug, nil
+	case "INFO":
+		return LevelInfo, nil
+	case "WARN", "WARNING":
+		return LevelWarn, nil
+	case "ERROR":
+		return LevelError, nil
+	case "FATAL":
+		return LevelFatal, nil
+	case "OFF":
+		return LevelOff, nil
+	}
+	return 0, fmt.Errorf("jsonlog: unknown level %q", s)
+}
+
+// fromSlog maps a slog level to the nearest level at or below it.
+func fromSlog(l slog.Level) Level {
+	switch {
+	case l < slog.LevelInfo:
+		return LevelDebug
+	case l < slog.LevelWarn:
+		return LevelInfo
+	case l < slog.LevelError:
+		return LevelWarn
+	case l < slog.Level(LevelFatal):
+		return LevelError
+	}
+	return LevelFatal
+}
+
+// core is the part of a logger shared with the loggers derived from it.
+type core struct {
 	out      io.Writer
-	minLevel Level
 	mu       sync.Mutex
+	minLevel atomic.Int32
+	sampler  atomic.Pointer[sampler]
+
+	// contextFields, if set, returns fields to add from the context of
+	// entries logged through the slog.Handler.
+	contextFields atomic.Pointer[func(context.Context) []slog.Attr]
+}
+
+// Logger writes entries as JSON lines. Loggers derived with With share the
+// output, level and sampling of the logger they came from.
+type Logger struct {
+	core *core
+	h    *handler
 }
 
 func NewLogger(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
-	}
+	c := &core{out: out}
+	c.minLevel.Store(int32(minLevel))
+
+	return &Logger{core: c, h: &handler{core: c}}
 }
 
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+// SetLevel changes the minimum level logged, here and in every logger
+// sharing this one's output. It is safe to call while logging.
+func (l *Logger) SetLevel(level Level) {
+	l.core.minLevel.Store(int32(level))
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+func (l *Logger) Level() Level {
+	return Level(l.core.minLevel.Load())
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
-	os.Exit(1)
+// SetContextFields sets a function returning fields to add to entries from
+// their context, such as a request ID. Only entries logged with a context,
+// through the slog.Handler, have one.
+func (l *Logger) SetContextFields(fn func(ctx context.Context) []slog.Attr) {
+	l.core.contextFields.Store(&fn)
 }
 
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
-		return 0, nil
-	}
+// With returns a logger that adds the given fields to every entry. Fields
+// are given as for slog: alternating keys and values, or slog.Attr values.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{core: l.core, h: l.h.withAttrs(argsToAttrs(args))}
+}
 
-	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
-	}{
-		Level:      level.String(),
-		Time:       time.Now().UTC().Format(time.RFC3339),
-		Message:    message,
-		Properties: properties,
-	}
+// Handler returns a slog.Handler writing to this logger, with its fields.
+func (l *Logger) Handler() slog.Handler {
+	return l.h
+}
+
+func (l *Logger) Debug(message string, args ...any) {
+	l.log(LevelDebug, message, argsToAttrs(args))
+}
+
+func (l *Logger) Info(message string, args ...any) {
+	l.log(LevelInfo, message, argsToAttrs(args))
+}
+
+func (l *Logger) Warn(message string, args ...any) {
+	l.log(LevelWarn, message, argsToAttrs(args))
+}
+
+func (l *Logger) Error(message string, args ...any) {
+	l.log(LevelError, message, argsToAttrs(args))
+}
+
+// Fatal logs at fatal level, with a stack trace, and exits.
+func (l *Logger) Fatal(message string, args ...any) {
+	l.log(LevelFatal, message, argsToAttrs(args))
+	os.Exit(1)
+}
 
-	if level >= LevelError {
-		aux.Trace = string(debug.Stack())
+func (l *Logger) log(level Level, message string, attrs []slog.Attr) {
+	if !l.h.enabled(level) {
+		return
 	}
+	l.h.write(context.Background(), level, time.Now(), message, attrs)
+}
 
-	var line []byte
+// Write logs message at error level, so that the logger can be used as the
+// output of a log.Logger, such as http.Server's ErrorLog.
+func (l *Logger) Write(message []byte) (n int, err error) {
+	l.log(LevelError, strings.TrimSuffix(string(message), "\n"), nil)
+	return len(message), nil
+}
 
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message:" + err.Error())
+// SetSampling limits how often the same message is logged: within each
+// tick, the first entries with a given level and message are logged, then
+// only every thereafter-th. Fatal entries are never dropped. A first of
+// zero turns sampling off.
+func (l *Logger) SetSampling(tick time.Duration, first, thereafter int) {
+	if first <= 0 {
+		l.core.sampler.Store(nil)
+		return
 	}
+	l.core.sampler.Store(newSampler(tick, first, thereafter))
+}
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// Dropped returns how many entries sampling has dropped.
+func (l *Logger) Dropped() int64 {
+	if s := l.core.sampler.Load(); s != nil {
+		return s.dropped.Load()
+	}
+	return 0
+}
 
-	return l.out.Write(append(line, '\n'))
+// stackTrace is added to fatal entries.
+func stackTrace() string {
+	return string(debug.Stack())
 }
 
-func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+const badKey = "!BADKEY"
+
+// argsToAttrs turns slog style arguments into attributes.
+func argsToAttrs(args []any) []slog.Attr {
+	var attrs []slog.Attr
+
+	for len(args) > 0 {
+		switch a := args[0].(type) {
+		case slog.Attr:
+			attrs = append(attrs, a)
+			args = args[1:]
+		case string:
+			if len(args) == 1 {
+				attrs = append(attrs, slog.String(badKey, a))
+				args = nil
+				continue
+			}
+			attrs = append(attrs, slog.Any(a, args[1]))
+			args = args[2:]
+		default:
+			attrs = append(attrs, slog.Any(badKey, a))
+			args = args[1:]
+		}
+	}
+
+	return attrs
 }
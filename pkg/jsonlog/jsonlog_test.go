@@ -0,0 +1,182 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevelString(t *testing.T) {
+	tests := []struct {
+		level Level
+		want  string
+	}{
+		{LevelDebug, "DEBUG"},
+		{LevelInfo, "INFO"},
+		{LevelWarn, "WARN"},
+		{LevelError, "ERROR"},
+		{LevelFatal, "FATAL"},
+		{LevelOff, "OFF"},
+		{Level(1), ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.level.String(); got != tt.want {
+			t.Errorf("Level(%d).String() = %q; want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{" warn ", LevelWarn, false},
+		{"warning", LevelWarn, false},
+		{"Error", LevelError, false},
+		{"fatal", LevelFatal, false},
+		{"off", LevelOff, false},
+		{"", 0, true},
+		{"verbose", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q): got error %v; want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+
+	// Every named level parses back from its name.
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal, LevelOff} {
+		if got, err := ParseLevel(l.String()); err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v", l.String(), got, err)
+		}
+	}
+}
+
+func TestFromSlog(t *testing.T) {
+	tests := []struct {
+		in   slog.Level
+		want Level
+	}{
+		{slog.LevelDebug - 4, LevelDebug},
+		{slog.LevelDebug, LevelDebug},
+		{slog.LevelInfo, LevelInfo},
+		{slog.LevelInfo + 2, LevelInfo},
+		{slog.LevelWarn, LevelWarn},
+		{slog.LevelError, LevelError},
+		{slog.LevelError + 2, LevelError},
+		{slog.Level(LevelFatal), LevelFatal},
+		{slog.Level(LevelFatal) + 10, LevelFatal},
+	}
+
+	for _, tt := range tests {
+		if got := fromSlog(tt.in); got != tt.want {
+			t.Errorf("fromSlog(%v) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	tests := []struct {
+		minLevel Level
+		want     []string
+	}{
+		{LevelDebug, []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{LevelInfo, []string{"INFO", "WARN", "ERROR"}},
+		{LevelWarn, []string{"WARN", "ERROR"}},
+		{LevelError, []string{"ERROR"}},
+		{LevelOff, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.minLevel.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := NewLogger(&buf, LevelInfo)
+			logger.SetLevel(tt.minLevel)
+
+			logger.Debug("message")
+			logger.Info("message")
+			logger.Warn("message")
+			logger.Error("message")
+
+			var got []string
+			for _, e := range entries(t, &buf) {
+				got = append(got, e.Level)
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+			if logger.Level() != tt.minLevel {
+				t.Errorf("got level %v", logger.Level())
+			}
+		})
+	}
+}
+
+func TestProperties(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo).With("component", "mailer")
+
+	logger.Info("sent", "attempts", 2, slog.Group("smtp", "host", "localhost"), "dangling")
+	logger.With("user_id", 42).Error("failed", "err", errors.New("timeout"))
+
+	got := entries(t, &buf)
+	if len(got) != 2 {
+		t.Fatalf("got %d entries", len(got))
+	}
+
+	want := `{"attempts":2,"component":"mailer","!BADKEY":"dangling","smtp":{"host":"localhost"}}`
+	if b, _ := json.Marshal(got[0].Properties); !jsonEqual(t, string(b), want) {
+		t.Errorf("got properties %s; want %s", b, want)
+	}
+
+	want = `{"component":"mailer","user_id":42,"err":"timeout"}`
+	if b, _ := json.Marshal(got[1].Properties); !jsonEqual(t, string(b), want) {
+		t.Errorf("got properties %s; want %s", b, want)
+	}
+}
+
+func entries(t *testing.T, buf *bytes.Buffer) []entry {
+	t.Helper()
+
+	var es []entry
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func jsonEqual(t *testing.T, a, b string) bool {
+	t.Helper()
+
+	var va, vb any
+	if err := json.Unmarshal([]byte(a), &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(b), &vb); err != nil {
+		t.Fatal(err)
+	}
+
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,72 @@
+package jsonlog
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSampled bounds the messages sampling keeps counts for. Messages built
+// from errors can vary endlessly, so the counts are reset when it's reached.
+const maxSampled = 4096
+
+type sampler struct {
+	tick       time.Duration
+	first      uint64
+	thereafter uint64
+	dropped    atomic.Int64
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	level   Level
+	message string
+}
+
+type sampleCount struct {
+	n       uint64
+	resetAt time.Time
+}
+
+func newSampler(tick time.Duration, first, thereafter int) *sampler {
+	if tick <= 0 {
+		tick = time.Second
+	}
+	if thereafter < 0 {
+		thereafter = 0
+	}
+
+	return &sampler{
+		tick:       tick,
+		first:      uint64(first),
+		thereafter: uint64(thereafter),
+		counts:     make(map[sampleKey]*sampleCount),
+	}
+}
+
+func (s *sampler) allow(level Level, message string) bool {
+	now := time.Now()
+	key := sampleKey{level, message}
+
+	s.mu.Lock()
+	c, ok := s.counts[key]
+	if !ok || now.After(c.resetAt) {
+		if !ok && len(s.counts) >= maxSampled {
+			s.counts = make(map[sampleKey]*sampleCount)
+		}
+		c = &sampleCount{resetAt: now.Add(s.tick)}
+		s.counts[key] = c
+	}
+	c.n++
+	n := c.n
+	s.mu.Unlock()
+
+	if n <= s.first || (s.thereafter > 0 && (n-s.first)%s.thereafter == 0) {
+		return true
+	}
+
+	s.dropped.Add(1)
+	return false
+}
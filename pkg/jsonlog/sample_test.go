@@ -0,0 +1,124 @@
+package jsonlog
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSamplerAllow(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      int
+		thereafter int
+		calls      int
+		want       int
+	}{
+		{"under first", 3, 10, 2, 2},
+		{"first only", 3, 0, 10, 3},
+		{"every tenth after", 3, 10, 25, 5},
+		{"every one after", 3, 1, 10, 10},
+		{"negative thereafter", 2, -1, 10, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSampler(time.Hour, tt.first, tt.thereafter)
+
+			allowed := 0
+			for i := 0; i < tt.calls; i++ {
+				if s.allow(LevelInfo, "message") {
+					allowed++
+				}
+			}
+
+			if allowed != tt.want {
+				t.Errorf("allowed %d; want %d", allowed, tt.want)
+			}
+			if got := s.dropped.Load(); got != int64(tt.calls-tt.want) {
+				t.Errorf("dropped %d; want %d", got, tt.calls-tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplerKeys(t *testing.T) {
+	s := newSampler(time.Hour, 1, 0)
+
+	tests := []struct {
+		level   Level
+		message string
+		want    bool
+	}{
+		{LevelInfo, "a", true},
+		{LevelInfo, "a", false},
+		{LevelInfo, "b", true},
+		{LevelError, "a", true},
+		{LevelError, "a", false},
+	}
+
+	for i, tt := range tests {
+		if got := s.allow(tt.level, tt.message); got != tt.want {
+			t.Errorf("%d: allow(%v, %q) = %t; want %t", i, tt.level, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestSamplerTick(t *testing.T) {
+	s := newSampler(time.Hour, 1, 0)
+
+	if !s.allow(LevelInfo, "message") || s.allow(LevelInfo, "message") {
+		t.Fatal("expected only the first entry")
+	}
+
+	// Once the tick has passed the count starts again.
+	s.counts[sampleKey{LevelInfo, "message"}].resetAt = time.Now().Add(-time.Millisecond)
+
+	if !s.allow(LevelInfo, "message") {
+		t.Error("entry after the tick dropped")
+	}
+}
+
+func TestSamplerMaxSampled(t *testing.T) {
+	s := newSampler(time.Hour, 1, 0)
+
+	for i := 0; i < maxSampled; i++ {
+		s.allow(LevelInfo, fmt.Sprint(i))
+	}
+	if len(s.counts) != maxSampled {
+		t.Fatalf("got %d counts", len(s.counts))
+	}
+
+	s.allow(LevelInfo, "one more")
+	if len(s.counts) != 1 {
+		t.Errorf("got %d counts after the limit; want them reset", len(s.counts))
+	}
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo)
+	logger.SetSampling(time.Hour, 2, 0)
+
+	for i := 0; i < 5; i++ {
+		logger.Info("noisy")
+	}
+
+	if got := len(entries(t, &buf)); got != 2 {
+		t.Errorf("got %d entries; want 2", got)
+	}
+	if got := logger.Dropped(); got != 3 {
+		t.Errorf("got %d dropped; want 3", got)
+	}
+
+	logger.SetSampling(0, 0, 0)
+	logger.Info("noisy")
+
+	if got := len(entries(t, &buf)); got != 1 {
+		t.Errorf("got %d entries with sampling off; want 1", got)
+	}
+	if got := logger.Dropped(); got != 0 {
+		t.Errorf("got %d dropped with sampling off", got)
+	}
+}
@@ -0,0 +1,275 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+
+	// leeway allows for a little clock skew between servers.
+	leeway = 30 * time.Second
+)
+
+var (
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	ErrExpired      = errors.New("jwt: token has expired")
+	ErrUnknownKey   = errors.New("jwt: unknown key id")
+)
+
+var b64 = base64.RawURLEncoding
+
+// Key is a named signing key. HS256 keys hold a shared secret, EdDSA keys an
+// Ed25519 private key.
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// ParseKey parses a key given as "kid:alg:material", where material is the
+// base64 encoded HS256 secret or Ed25519 seed (or full private key).
+func ParseKey(spec string) (Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return Key{}, fmt.Errorf("jwt: key must be in the form kid:alg:base64-material")
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Key{}, fmt.Errorf("jwt: key %q: %w", parts[0], err)
+	}
+
+	key := Key{ID: parts[0], Algorithm: parts[1]}
+
+	switch key.Algorithm {
+	case AlgHS256:
+		if len(material) < 32 {
+			return Key{}, fmt.Errorf("jwt: key %q: HS256 secret must be at least 32 bytes", key.ID)
+		}
+		key.secret = material
+	case AlgEdDSA:
+		switch len(material) {
+		case ed25519.SeedSize:
+			key.privateKey = ed25519.NewKeyFromSeed(material)
+		case ed25519.PrivateKeySize:
+			key.privateKey = ed25519.PrivateKey(material)
+		default:
+			return Key{}, fmt.Errorf("jwt: key %q: Ed25519 key must be a 32 byte seed or 64 byte private key", key.ID)
+		}
+		key.publicKey = key.privateKey.Public().(ed25519.PublicKey)
+	default:
+		return Key{}, fmt.Errorf("jwt: key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	return key, nil
+}
+
+func (k Key) sign(input []byte) []byte {
+	if k.Algorithm == AlgHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.privateKey, input)
+}
+
+func (k Key) verify(input, signature []byte) bool {
+	if k.Algorithm == AlgHS256 {
+		return hmac.Equal(k.sign(input), signature)
+	}
+	return ed25519.Verify(k.publicKey, input, signature)
+}
+
+// Audience is the "aud" claim, which may be a single string or an array.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a Audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisteredClaims are the standard claims checked by Verify. Embed it in
+// a struct to add application specific claims.
+type RegisteredClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+func (c *RegisteredClaims) registered() *RegisteredClaims {
+	return c
+}
+
+// Claims is implemented by any struct embedding RegisteredClaims.
+type Claims interface {
+	registered() *RegisteredClaims
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Manager signs tokens with its current key and verifies tokens signed with
+// any of its keys, so old keys can be kept around while they are rotated out.
+type Manager struct {
+	keys     map[string]Key
+	signing  Key
+	issuer   string
+	audience string
+}
+
+func NewManager(keys []Key, signingKeyID, issuer, audience string) (*Manager, error) {
+	m := &Manager{
+		keys:     make(map[string]Key),
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	for _, k := range keys {
+		if _, exists := m.keys[k.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", k.ID)
+		}
+		m.keys[k.ID] = k
+	}
+
+	if signingKeyID == "" && len(keys) > 0 {
+		signingKeyID = keys[0].ID
+	}
+
+	signing, ok := m.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: signing key %q not found", signingKeyID)
+	}
+	m.signing = signing
+
+	return m, nil
+}
+
+// Sign fills in the issuer, audience and issue time of claims and returns
+// the signed token. The caller is responsible for the subject and expiry.
+func (m *Manager) Sign(claims Claims) (string, error) {
+	rc := claims.registered()
+	rc.Issuer = m.issuer
+	rc.IssuedAt = time.Now().Unix()
+	if m.audience != "" {
+		rc.Audience = Audience{m.audience}
+	}
+
+	h, err := json.Marshal(header{Algorithm: m.signing.Algorithm, Type: "JWT", KeyID: m.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(payload)
+	signature := m.signing.sign([]byte(input))
+
+	return input + "." + b64.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature and registered claims and decodes its
+// payload into claims.
+func (m *Manager) Verify(token string, claims Claims) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err = json.Unmarshal(rawHeader, &h); err != nil {
+		return ErrInvalidToken
+	}
+
+	key, ok := m.keys[h.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	// The algorithm is fixed by the key, never taken from the token, so a
+	// token can't downgrade itself to a weaker algorithm or "none".
+	if h.Algorithm != key.Algorithm {
+		return ErrInvalidToken
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidToken
+	}
+
+	rc := claims.registered()
+	now := time.Now()
+
+	switch {
+	case rc.ExpiresAt == 0:
+		return ErrInvalidToken
+	case now.After(time.Unix(rc.ExpiresAt, 0).Add(leeway)):
+		return ErrExpired
+	case rc.NotBefore != 0 && now.Add(leeway).Before(time.Unix(rc.NotBefore, 0)):
+		return ErrInvalidToken
+	case m.issuer != "" && rc.Issuer != m.issuer:
+		return ErrInvalidToken
+	case m.audience != "" && !rc.Audience.contains(m.audience):
+		return ErrInvalidToken
+	}
+
+	return nil
+}
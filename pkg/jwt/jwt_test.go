@@ -0,0 +1,286 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+var (
+	hsSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	edSeed   = base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+)
+
+func mustKey(t *testing.T, spec string) Key {
+	t.Helper()
+
+	key, err := ParseKey(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseKey(t *testing.T) {
+	fullKey := base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{"hs256", "k1:HS256:" + hsSecret, false},
+		{"ed25519 seed", "k2:EdDSA:" + edSeed, false},
+		{"ed25519 private key", "k3:EdDSA:" + fullKey, false},
+		{"missing parts", "k1:HS256", true},
+		{"missing id", ":HS256:" + hsSecret, true},
+		{"bad base64", "k1:HS256:not base64!", true},
+		{"short secret", "k1:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+		{"bad ed25519 size", "k1:EdDSA:" + hsSecret[:8], true},
+		{"unsupported algorithm", "k1:RS256:" + hsSecret, true},
+		{"none", "k1:none:" + hsSecret, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewManager(t *testing.T) {
+	k1 := mustKey(t, "k1:HS256:"+hsSecret)
+	k2 := mustKey(t, "k2:EdDSA:"+edSeed)
+
+	tests := []struct {
+		name      string
+		keys      []Key
+		signingID string
+		wantID    string
+		wantErr   bool
+	}{
+		{"first key by default", []Key{k1, k2}, "", "k1", false},
+		{"chosen key", []Key{k1, k2}, "k2", "k2", false},
+		{"unknown signing key", []Key{k1}, "k9", "", true},
+		{"no keys", nil, "", "", true},
+		{"duplicate ids", []Key{k1, k1}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewManager(tt.keys, tt.signingID, "iss", "aud")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if err == nil && m.signing.ID != tt.wantID {
+				t.Errorf("signing with %q; want %q", m.signing.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, spec := range []string{"k1:HS256:" + hsSecret, "k2:EdDSA:" + edSeed} {
+		key := mustKey(t, spec)
+
+		t.Run(key.Algorithm, func(t *testing.T) {
+			m, err := NewManager([]Key{key}, "", "marvel-shop", "marvel-shop-api")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in := &testClaims{Scope: "authentication"}
+			in.Subject = "42"
+			in.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+			token, err := m.Sign(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out testClaims
+			if err := m.Verify(token, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if out.Subject != "42" || out.Scope != "authentication" || out.Issuer != "marvel-shop" {
+				t.Errorf("got claims %+v", out)
+			}
+			if !out.Audience.contains("marvel-shop-api") {
+				t.Errorf("got audience %v", out.Audience)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	old := mustKey(t, "old:HS256:"+hsSecret)
+	current := mustKey(t, "new:EdDSA:"+edSeed)
+
+	before, err := NewManager([]Key{old}, "", "iss", "aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &testClaims{}
+	claims.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	token, err := before.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := NewManager([]Key{current, old}, "new", "iss", "aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := after.Verify(token, &testClaims{}); err != nil {
+		t.Errorf("token signed with the old key: %v", err)
+	}
+
+	retired, err := NewManager([]Key{current}, "", "iss", "aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := retired.Verify(token, &testClaims{}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v once the old key is removed; want ErrUnknownKey", err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	key := mustKey(t, "k1:HS256:"+hsSecret)
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		claims   RegisteredClaims
+		want     error
+		issuer   string
+		audience string
+	}{
+		{"valid", RegisteredClaims{ExpiresAt: now.Add(time.Minute).Unix()}, nil, "iss", "aud"},
+		{"no expiry", RegisteredClaims{}, ErrInvalidToken, "iss", "aud"},
+		{"expired", RegisteredClaims{ExpiresAt: now.Add(-time.Minute).Unix()}, ErrExpired, "iss", "aud"},
+		{"expired within leeway", RegisteredClaims{ExpiresAt: now.Add(-10 * time.Second).Unix()}, nil, "iss", "aud"},
+		{"not yet valid", RegisteredClaims{ExpiresAt: now.Add(time.Hour).Unix(), NotBefore: now.Add(time.Minute).Unix()}, ErrInvalidToken, "iss", "aud"},
+		{"not before within leeway", RegisteredClaims{ExpiresAt: now.Add(time.Hour).Unix(), NotBefore: now.Add(10 * time.Second).Unix()}, nil, "iss", "aud"},
+		{"other issuer", RegisteredClaims{ExpiresAt: now.Add(time.Minute).Unix()}, ErrInvalidToken, "other", "aud"},
+		{"other audience", RegisteredClaims{ExpiresAt: now.Add(time.Minute).Unix()}, ErrInvalidToken, "iss", "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewManager([]Key{key}, "", tt.issuer, tt.audience)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier, err := NewManager([]Key{key}, "", "iss", "aud")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims := &testClaims{RegisteredClaims: tt.claims}
+			token, err := signer.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := verifier.Verify(token, &testClaims{}); !errors.Is(err, tt.want) {
+				t.Errorf("got %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	key := mustKey(t, "k1:HS256:"+hsSecret)
+	m, err := NewManager([]Key{key}, "", "iss", "aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &testClaims{Scope: "user"}
+	claims.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	token, err := m.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b64.EncodeToString(b)
+	}
+
+	elevated := *claims
+	elevated.Scope = "admin"
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"two parts", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"changed payload", parts[0] + "." + encode(elevated) + "." + parts[2], ErrInvalidToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!", ErrInvalidToken},
+		{"empty signature", parts[0] + "." + parts[1] + ".", ErrInvalidToken},
+		{"alg none", encode(header{Algorithm: "none", Type: "JWT", KeyID: "k1"}) + "." + parts[1] + ".", ErrInvalidToken},
+		{"alg switched", encode(header{Algorithm: AlgEdDSA, Type: "JWT", KeyID: "k1"}) + "." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"unknown kid", encode(header{Algorithm: AlgHS256, Type: "JWT", KeyID: "k9"}) + "." + parts[1] + "." + parts[2], ErrUnknownKey},
+		{"bad header", "e30x." + parts[1] + "." + parts[2], ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Verify(tt.token, &testClaims{}); !errors.Is(err, tt.want) {
+				t.Errorf("got %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want Audience
+	}{
+		{`"api"`, Audience{"api"}},
+		{`["api","web"]`, Audience{"api", "web"}},
+	}
+
+	for _, tt := range tests {
+		var a Audience
+		if err := json.Unmarshal([]byte(tt.json), &a); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if strings.Join(a, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v; want %v", tt.json, a, tt.want)
+		}
+
+		b, err := json.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.json {
+			t.Errorf("got %s; want %s", b, tt.json)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	tt "text/template"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+const (
+	attempts = 3
+	timeout  = 10 * time.Second
+)
+
+// Mailer delivers templated emails over SMTP. Each template in the templates
+// directory defines "subject", "plainBody" and "htmlBody".
+type Mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	sender   string
+}
+
+func New(host string, port int, username, password, sender string) Mailer {
+	return Mailer{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		sender:   sender,
+	}
+}
+
+// Send renders templateName with data and sends it to recipient, retrying a
+// couple of times before giving up.
+func (m Mailer) Send(recipient, templateName string, data interface{}) error {
+	msg, err := m.render(recipient, templateName+".tmpl", data)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= attempts; i++ {
+		err = m.deliver(recipient, msg)
+		if err == nil {
+			return nil
+		}
+
+		if i < attempts {
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+	}
+
+	return fmt.Errorf("mailer: sending %q to %s: %w", templateName, recipient, err)
+}
+
+func (m Mailer) render(recipient, templateFile string, data interface{}) ([]byte, error) {
+	textTmpl, err := tt.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	if err = textTmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	if err = textTmpl.ExecuteTemplate(plainBody, "plainBody", data); err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	if err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data); err != nil {
+		return nil, err
+	}
+
+	msg := new(bytes.Buffer)
+	mw := multipart.NewWriter(msg)
+
+	fmt.Fprintf(msg, "From: %s\r\n", m.sender)
+	fmt.Fprintf(msg, "To: %s\r\n", recipient)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"text/plain; charset=UTF-8", plainBody.Bytes()},
+		{"text/html; charset=UTF-8", htmlBody.Bytes()},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(pw)
+		if _, err = qp.Write(part.body); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+func (m Mailer) deliver(recipient string, msg []byte) error {
+	from, err := mail.ParseAddress(m.sender)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+
+	// Local SMTP stand-ins such as MailHog don't need credentials.
+	if m.username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(recipient); err != nil {
+		return err
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
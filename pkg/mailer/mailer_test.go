@@ -0,0 +1,376 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSender = "Marvel Shop <no-reply@marvelshop.local>"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		template string
+		data     map[string]interface{}
+		subject  string
+		contains string
+	}{
+		{"user_welcome", map[string]interface{}{"userID": 7, "activationToken": "ACTIVATETOKEN"}, "Welcome to the Marvel shop!", "ACTIVATETOKEN"},
+		{"token_activation", map[string]interface{}{"activationToken": "ACTIVATETOKEN"}, "Activate your Marvel shop account", "ACTIVATETOKEN"},
+		{"token_password_reset", map[string]interface{}{"passwordResetToken": "RESETTOKEN"}, "Reset your Marvel shop password", "RESETTOKEN"},
+		{"token_email_change", map[string]interface{}{"emailChangeToken": "CHANGETOKEN"}, "Confirm your new Marvel shop email address", "CHANGETOKEN"},
+		{"order_confirmation", map[string]interface{}{"orderID": 42, "name": "Peter", "productID": 3, "quantity": 2}, "Your Marvel shop order #42", "Peter"},
+	}
+
+	m := New("localhost", 1025, "", "", testSender)
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			raw, err := m.render("peter@example.com", tt.template+".tmpl", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, subject, parts := parseMessage(t, raw)
+
+			if got := msg.Header.Get("To"); got != "peter@example.com" {
+				t.Errorf("got To %q", got)
+			}
+			if got := msg.Header.Get("From"); got != testSender {
+				t.Errorf("got From %q", got)
+			}
+			if !strings.HasPrefix(subject, tt.subject) {
+				t.Errorf("got subject %q; want %q", subject, tt.subject)
+			}
+
+			for _, contentType := range []string{"text/plain", "text/html"} {
+				body, ok := parts[contentType]
+				if !ok {
+					t.Errorf("no %s part", contentType)
+					continue
+				}
+				if !strings.Contains(body, tt.contains) {
+					t.Errorf("%s part doesn't contain %q:\n%s", contentType, tt.contains, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	m := New("localhost", 1025, "", "", testSender)
+
+	if _, err := m.render("peter@example.com", "no_such_template.tmpl", nil); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRenderEscapesHTML(t *testing.T) {
+	m := New("localhost", 1025, "", "", testSender)
+
+	data := map[string]interface{}{"orderID": 1, "name": "<b>Peter</b>", "productID": 1, "quantity": 1}
+	raw, err := m.render("peter@example.com", "order_confirmation.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, parts := parseMessage(t, raw)
+
+	if strings.Contains(parts["text/html"], "<b>Peter</b>") {
+		t.Error("HTML part contains the unescaped name")
+	}
+	if !strings.Contains(parts["text/plain"], "<b>Peter</b>") {
+		t.Error("plain part doesn't contain the name as given")
+	}
+}
+
+func TestSend(t *testing.T) {
+	server := newFakeSMTPServer(t, 0)
+
+	m := New("127.0.0.1", server.port, "", "", testSender)
+
+	err := m.Send("peter@example.com", "token_activation", map[string]interface{}{"activationToken": "ACTIVATETOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := server.message(t)
+
+	if got.from != "no-reply@marvelshop.local" {
+		t.Errorf("got MAIL FROM %q", got.from)
+	}
+	if got.to != "peter@example.com" {
+		t.Errorf("got RCPT TO %q", got.to)
+	}
+
+	_, subject, parts := parseMessage(t, got.data)
+	if subject != "Activate your Marvel shop account" {
+		t.Errorf("got subject %q", subject)
+	}
+	if !strings.Contains(parts["text/plain"], "ACTIVATETOKEN") {
+		t.Errorf("plain part doesn't contain the token:\n%s", parts["text/plain"])
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	server := newFakeSMTPServer(t, 1)
+
+	m := New("127.0.0.1", server.port, "", "", testSender)
+
+	err := m.Send("peter@example.com", "token_activation", map[string]interface{}{"activationToken": "ACTIVATETOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.message(t)
+}
+
+func TestSendFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	m := New("127.0.0.1", port, "", "", testSender)
+
+	err = m.Send("peter@example.com", "token_activation", map[string]interface{}{"activationToken": "x"})
+	if err == nil || !strings.Contains(err.Error(), "token_activation") {
+		t.Errorf("got error %v; want one naming the template", err)
+	}
+}
+
+// TestSendMailHog sends through a real MailHog, such as the one
+// docker-compose starts, and reads the message back from its API. It runs
+// only when MAILHOG_URL is set, e.g. MAILHOG_URL=http://localhost:8025, with
+// SMTP on port MAILHOG_SMTP_PORT (1025).
+func TestSendMailHog(t *testing.T) {
+	apiURL := os.Getenv("MAILHOG_URL")
+	if apiURL == "" {
+		t.Skip("MAILHOG_URL not set")
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := 1025
+	if p := os.Getenv("MAILHOG_SMTP_PORT"); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recipient := fmt.Sprintf("mailer-test-%d@example.com", time.Now().UnixNano())
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	m := New(u.Hostname(), port, "", "", testSender)
+
+	err = m.Send(recipient, "token_password_reset", map[string]interface{}{"passwordResetToken": token})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found struct {
+		Total int `json:"total"`
+		Items []struct {
+			Raw struct {
+				Data string `json:"Data"`
+			} `json:"Raw"`
+		} `json:"items"`
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for found.Total == 0 && time.Now().Before(deadline) {
+		res, err := http.Get(strings.TrimSuffix(apiURL, "/") + "/api/v2/search?kind=to&query=" + url.QueryEscape(recipient))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(res.Body).Decode(&found)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.Total == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if found.Total != 1 {
+		t.Fatalf("MailHog has %d messages for %s; want 1", found.Total, recipient)
+	}
+
+	_, subject, parts := parseMessage(t, []byte(found.Items[0].Raw.Data))
+	if subject != "Reset your Marvel shop password" {
+		t.Errorf("got subject %q", subject)
+	}
+	if !strings.Contains(parts["text/plain"], token) {
+		t.Errorf("plain part doesn't contain the token:\n%s", parts["text/plain"])
+	}
+}
+
+// parseMessage parses a rendered message, returning its decoded subject and
+// the decoded body of each part by content type.
+func parseMessage(t *testing.T, raw []byte) (*mail.Message, string, map[string]string) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("got content type %q", mediaType)
+	}
+
+	parts := make(map[string]string)
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[contentType] = string(body)
+	}
+
+	return msg, subject, parts
+}
+
+type smtpMessage struct {
+	from, to string
+	data     []byte
+}
+
+// fakeSMTPServer accepts just enough SMTP to deliver a message. The first
+// dropConns connections are closed straight away, to exercise retries.
+type fakeSMTPServer struct {
+	port     int
+	messages chan smtpMessage
+}
+
+func newFakeSMTPServer(t *testing.T, dropConns int) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeSMTPServer{
+		port:     l.Addr().(*net.TCPAddr).Port,
+		messages: make(chan smtpMessage, 1),
+	}
+
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if i < dropConns {
+				conn.Close()
+				continue
+			}
+			s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	var msg smtpMessage
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line[4:], " FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			msg.to = strings.Trim(strings.TrimPrefix(line[4:], " TO:"), "<>")
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data bytes.Buffer
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg.data = data.Bytes()
+			s.messages <- msg
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) message(t *testing.T) smtpMessage {
+	t.Helper()
+
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return smtpMessage{}
+	}
+}
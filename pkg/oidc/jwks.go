@@ -0,0 +1,96 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	KeyID   string `json:"kid"`
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// parse returns the usable signing keys in the set by key ID. Keys of types
+// we don't support are skipped.
+func (s jwks) parse() map[string]interface{} {
+	keys := make(map[string]interface{})
+
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.KeyType {
+		case "RSA":
+			n, err1 := b64.DecodeString(k.N)
+			e, err2 := b64.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.KeyID] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if k.Curve != "P-256" {
+				continue
+			}
+			x, err1 := b64.DecodeString(k.X)
+			y, err2 := b64.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.KeyID] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys
+}
+
+func verifySignature(alg string, key interface{}, input, signature []byte) error {
+	digest := sha256.Sum256(input)
+
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key does not match algorithm %s", ErrInvalidIDToken, alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidIDToken
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("%w: key does not match algorithm %s", ErrInvalidIDToken, alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidIDToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, alg)
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+
+	b64 = base64.RawURLEncoding
+)
+
+// Config describes the client registration with the identity provider.
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// metadata is the subset of the provider's discovery document we use.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to an OpenID Connect identity provider. Its metadata is
+// discovered on first use rather than at startup, so the API can come up
+// before the provider does.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	meta     *metadata
+	keys     map[string]interface{}
+	keysTime time.Time
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}
+}
+
+// Claims are the ID token claims used to find or create a user.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// NewPKCE returns a random code verifier and its S256 code challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, b64.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns n random bytes, base64url encoded. It is used for
+// state, nonce and PKCE values.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the provider URL to send the user to.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified claims of
+// the ID token that came with it.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err = p.do(req, &tokens); err != nil {
+		return nil, fmt.Errorf("oidc: token exchange: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+
+	return p.verify(ctx, meta, tokens.IDToken, nonce)
+}
+
+func (p *Provider) verify(ctx context.Context, meta *metadata, rawToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, meta, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	if err = verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(time.Minute)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// discover fetches the discovery document the first time it is needed.
+// The lock isn't held while fetching, so a slow provider doesn't hold up
+// calls that only need what is already cached.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	cached := p.meta
+	p.mu.Unlock()
+
+	if cached != nil {
+		return cached, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta metadata
+	if err = p.do(req, &meta); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if meta.Issuer != strings.TrimSuffix(p.config.IssuerURL, "/") && meta.Issuer != p.config.IssuerURL {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q does not match %q", meta.Issuer, p.config.IssuerURL)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Another call may have got there first; keep what it stored.
+	if p.meta == nil {
+		p.meta = &meta
+	}
+	return p.meta, nil
+}
+
+// key returns the provider's signing key with the given ID, refetching the
+// key set when the ID is unknown, which is how providers roll keys over.
+func (p *Provider) key(ctx context.Context, meta *metadata, kid string) (interface{}, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	recent := p.keys != nil && time.Since(p.keysTime) < 10*time.Second
+	p.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	// Don't let tokens with made up key IDs make us hammer the provider.
+	if recent {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidIDToken, kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jwks
+	if err = p.do(req, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetching keys: %w", err)
+	}
+
+	keys := set.parse()
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysTime = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidIDToken, kid)
+}
+
+func (p *Provider) do(req *http.Request, dst interface{}) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, dst)
+}
+
+func decodeSegment(seg string, dst interface{}) error {
+	b, err := b64.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
@@ -0,0 +1,505 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID    = "shop"
+	testRedirectURL = "http://localhost:8081/api/v1/oidc/callback"
+)
+
+// mockProvider is a minimal OpenID Connect provider: discovery, a key set
+// and a token endpoint that checks PKCE before handing out an ID token.
+type mockProvider struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	issuer      string
+	kids        map[string]bool
+	codes       map[string]mockCode
+	jwksFetches int
+
+	// jwksGate, when set, holds key set requests until it is closed.
+	jwksGate chan struct{}
+}
+
+type mockCode struct {
+	challenge string
+	idToken   string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{
+		t:      t,
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+		kids:   map[string]bool{"rsa-1": true, "ec-1": true},
+		codes:  make(map[string]mockCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/token", m.token)
+
+	m.srv = httptest.NewServer(mux)
+	m.issuer = m.srv.URL
+	t.Cleanup(m.srv.Close)
+
+	return m
+}
+
+func (m *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	issuer := m.issuer
+	m.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": m.srv.URL + "/authorize",
+		"token_endpoint":         m.srv.URL + "/token",
+		"jwks_uri":               m.srv.URL + "/jwks",
+	})
+}
+
+func (m *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.jwksFetches++
+	gate := m.jwksGate
+	m.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []map[string]string
+	for kid := range m.kids {
+		if strings.HasPrefix(kid, "rsa") {
+			keys = append(keys, map[string]string{
+				"kid": kid, "kty": "RSA", "use": "sig",
+				"n": b64.EncodeToString(m.rsaKey.N.Bytes()),
+				"e": b64.EncodeToString(big.NewInt(int64(m.rsaKey.E)).Bytes()),
+			})
+		} else {
+			keys = append(keys, map[string]string{
+				"kid": kid, "kty": "EC", "use": "sig", "crv": "P-256",
+				"x": b64.EncodeToString(m.ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64.EncodeToString(m.ecKey.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	// An encryption key, which must be ignored.
+	keys = append(keys, map[string]string{"kid": "enc-1", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("client_id") != testClientID,
+		r.PostForm.Get("redirect_uri") != testRedirectURL,
+		!ok,
+		b64.EncodeToString(sum[:]) != code.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": code.idToken})
+}
+
+// authorize stands in for the user signing in at the provider: it records
+// an authorization code for the challenge, redeemable for idToken.
+func (m *mockProvider) authorize(code, challenge, idToken string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.codes[code] = mockCode{challenge: challenge, idToken: idToken}
+}
+
+// sign returns an ID token with the given claims, signed with the key for
+// alg under kid.
+func (m *mockProvider) sign(alg, kid string, claims map[string]interface{}) string {
+	m.t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			m.t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, m.ecKey, digest[:])
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return input + "." + b64.EncodeToString(signature)
+}
+
+func (m *mockProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            m.srv.URL,
+		"sub":            "user-123",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "peter@example.com",
+		"email_verified": true,
+		"name":           "Peter Parker",
+	}
+}
+
+func (m *mockProvider) provider() *Provider {
+	return NewProvider(Config{
+		IssuerURL:   m.srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	})
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	m := newMockProvider(t)
+
+	raw, err := m.provider().AuthCodeURL(context.Background(), "state-1", "nonce-1", "challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Scheme + "://" + u.Host + u.Path; got != m.srv.URL+"/authorize" {
+		t.Errorf("got endpoint %s", got)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        "challenge-1",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("%s = %q; want %q", k, got, v)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	m := newMockProvider(t)
+
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		modify  func(claims map[string]interface{})
+		token   func(token string) string
+		wantErr error
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa-1"},
+		{name: "ES256", alg: "ES256", kid: "ec-1"},
+		{name: "audience list", alg: "RS256", kid: "rsa-1", modify: func(c map[string]interface{}) {
+			c["aud"] = []string{"other", testClientID}
+		}},
+		{name: "other audience", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, modify: func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}},
+		{name: "other issuer", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, modify: func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}},
+		{name: "expired", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, modify: func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+		}},
+		{name: "wrong nonce", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, modify: func(c map[string]interface{}) {
+			c["nonce"] = "replayed"
+		}},
+		{name: "no subject", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, modify: func(c map[string]interface{}) {
+			delete(c, "sub")
+		}},
+		{name: "unknown key", alg: "RS256", kid: "rsa-9", wantErr: ErrInvalidIDToken},
+		{name: "key of another type", alg: "RS256", kid: "ec-1", wantErr: ErrInvalidIDToken},
+		{name: "encryption key", alg: "RS256", kid: "enc-1", wantErr: ErrInvalidIDToken},
+		{name: "tampered payload", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, token: func(token string) string {
+			parts := strings.Split(token, ".")
+			payload, _ := json.Marshal(map[string]interface{}{"sub": "admin"})
+			return parts[0] + "." + b64.EncodeToString(payload) + "." + parts[2]
+		}},
+		{name: "alg none", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, token: func(token string) string {
+			parts := strings.Split(token, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa-1"})
+			return b64.EncodeToString(header) + "." + parts[1] + "."
+		}},
+		{name: "not a JWT", alg: "RS256", kid: "rsa-1", wantErr: ErrInvalidIDToken, token: func(string) string {
+			return "garbage"
+		}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := m.provider()
+
+			verifier, challenge, err := NewPKCE()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonce := "nonce-" + tt.name
+			claims := m.claims(nonce)
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+
+			token := m.sign(tt.alg, tt.kid, claims)
+			if tt.token != nil {
+				token = tt.token(token)
+			}
+
+			code := "code-" + string(rune('a'+i))
+			m.authorize(code, challenge, token)
+
+			got, err := p.Exchange(context.Background(), code, verifier, nonce)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got.Subject != "user-123" || got.Email != "peter@example.com" || !got.EmailVerified || got.Name != "Peter Parker" {
+				t.Errorf("got claims %+v", got)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectedCode(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.authorize("code-1", challenge, m.sign("RS256", "rsa-1", m.claims("n")))
+
+	tests := []struct {
+		name     string
+		code     string
+		verifier string
+	}{
+		{"wrong verifier", "code-1", verifier + "x"},
+		// The code has been used up by the attempt above.
+		{"code reused", "code-1", verifier},
+		{"unknown code", "code-2", verifier},
+	}
+
+	for _, tt := range tests {
+		_, err := p.Exchange(context.Background(), tt.code, tt.verifier, "n")
+		if err == nil || errors.Is(err, ErrInvalidIDToken) || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Errorf("%s: got error %v; want the provider's invalid_grant", tt.name, err)
+		}
+	}
+}
+
+func TestKeyRollover(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	exchange := func(kid string) error {
+		verifier, challenge, err := NewPKCE()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := RandomString(8)
+		m.authorize(code, challenge, m.sign("RS256", kid, m.claims("n")))
+
+		_, err = p.Exchange(context.Background(), code, verifier, "n")
+		return err
+	}
+
+	if err := exchange("rsa-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchange("rsa-1"); err != nil {
+		t.Fatal(err)
+	}
+	if m.jwksFetches != 1 {
+		t.Errorf("key set fetched %d times; want it cached", m.jwksFetches)
+	}
+
+	// The provider rolls over to a new key ID. Tokens with it are accepted
+	// once the key set is refetched, but not too often.
+	m.mu.Lock()
+	m.kids = map[string]bool{"rsa-2": true}
+	m.mu.Unlock()
+
+	if err := exchange("rsa-2"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("got %v straight after the last fetch; want ErrInvalidIDToken", err)
+	}
+
+	p.mu.Lock()
+	p.keysTime = time.Now().Add(-time.Minute)
+	p.mu.Unlock()
+
+	if err := exchange("rsa-2"); err != nil {
+		t.Errorf("new key rejected after refetching: %v", err)
+	}
+	if m.jwksFetches != 2 {
+		t.Errorf("key set fetched %d times; want 2", m.jwksFetches)
+	}
+}
+
+// TestKeyFetchUnlocked checks that a slow key set fetch doesn't hold up
+// calls that only need the cached metadata.
+func TestKeyFetchUnlocked(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	ctx := context.Background()
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gate := make(chan struct{})
+	m.mu.Lock()
+	m.jwksGate = gate
+	m.mu.Unlock()
+
+	fetched := make(chan error)
+	go func() {
+		_, err := p.key(ctx, meta, "rsa-1")
+		fetched <- err
+	}()
+
+	// Wait for the fetch to reach the provider.
+	for {
+		m.mu.Lock()
+		n := m.jwksFetches
+		m.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := p.AuthCodeURL(ctx, "s", "n", "c")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("AuthCodeURL blocked by the key set fetch")
+	}
+
+	close(gate)
+	if err := <-fetched; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+
+	m.mu.Lock()
+	m.issuer = "https://evil.example.com"
+	m.mu.Unlock()
+
+	_, err := m.provider().AuthCodeURL(context.Background(), "s", "n", "c")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("got %v; want an issuer mismatch", err)
+	}
+}
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 7636 requires 43 to 128 characters from the unreserved set.
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("verifier is %d characters", len(verifier))
+	}
+	if strings.Trim(verifier, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~") != "" {
+		t.Errorf("verifier %q has reserved characters", verifier)
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != b64.EncodeToString(sum[:]) {
+		t.Error("challenge isn't the S256 of the verifier")
+	}
+}
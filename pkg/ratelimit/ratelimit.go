@@ -0,0 +1,105 @@
+// Package ratelimit implements token bucket rate limiting with pluggable
+// storage for the buckets, so that limits can be shared between instances.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket: it holds up to Burst tokens and refills
+// at Rate tokens per second. Each request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Window is how long an empty bucket takes to refill completely.
+func (l Limit) Window() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// RetryAfter is how long until a token is available, zero if Allowed.
+	RetryAfter time.Duration
+
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps token buckets by key.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// MemoryStore keeps buckets in process memory. Buckets that have refilled
+// completely are dropped, since a new bucket starts out full anyway.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	result := Result{Limit: limit.Burst}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimitWindow(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  time.Duration
+	}{
+		{Limit{Rate: 2, Burst: 4}, 2 * time.Second},
+		{Limit{Rate: 0.2, Burst: 5}, 25 * time.Second},
+		{Limit{Rate: 3.0 / 3600, Burst: 3}, time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := tt.limit.Window()
+		if d := got - tt.want; d > time.Millisecond || d < -time.Millisecond {
+			t.Errorf("%+v: got %s; want %s", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		name          string
+		taken         int
+		idle          time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{"first request", 0, 0, true, 2},
+		{"last token", 2, 0, true, 0},
+		{"empty bucket", 3, 0, false, 0},
+		{"partly refilled", 3, 1500 * time.Millisecond, true, 0},
+		{"refilled", 3, time.Minute, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			ctx := context.Background()
+
+			for i := 0; i < tt.taken; i++ {
+				if _, err := s.Take(ctx, "key", limit); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Wind the bucket's clock back rather than sleeping.
+			if b, ok := s.buckets["key"]; ok {
+				b.last = b.last.Add(-tt.idle)
+			}
+
+			result, err := s.Take(ctx, "key", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Allowed != tt.wantAllowed || result.Remaining != tt.wantRemaining {
+				t.Errorf("got allowed %t remaining %d; want %t and %d", result.Allowed, result.Remaining, tt.wantAllowed, tt.wantRemaining)
+			}
+			if result.Limit != limit.Burst {
+				t.Errorf("got limit %d; want %d", result.Limit, limit.Burst)
+			}
+			if result.Allowed && result.RetryAfter != 0 {
+				t.Errorf("got RetryAfter %s for an allowed request", result.RetryAfter)
+			}
+			if !result.Allowed && (result.RetryAfter <= 0 || result.RetryAfter > time.Second) {
+				t.Errorf("got RetryAfter %s; want up to 1s", result.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 1}
+
+	for _, key := range []string{"a", "b"} {
+		result, err := s.Take(ctx, key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed {
+			t.Errorf("%s: first request refused", key)
+		}
+	}
+
+	result, err := s.Take(ctx, "a", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Error("second request for a allowed")
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	for _, key := range []string{"idle", "busy"} {
+		if _, err := s.Take(ctx, key, limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.buckets["idle"].full = time.Now().Add(-time.Second)
+	s.lastPrune = time.Now().Add(-2 * time.Minute)
+
+	if _, err := s.Take(ctx, "busy", limit); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.buckets["idle"]; ok {
+		t.Error("full bucket not pruned")
+	}
+	if _, ok := s.buckets["busy"]; !ok {
+		t.Error("bucket in use pruned")
+	}
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills and takes from a bucket in one atomic step. Buckets
+// are hashes holding the token count and the time of the last update in
+// milliseconds, taken from the Redis server so that instances with
+// different clocks agree. Idle buckets expire once they would be full.
+var takeScript = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate * 1000)
+end
+local reset = math.ceil((burst - tokens) / rate * 1000)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], reset + 1000)
+return {allowed, math.floor(tokens), retry, reset}
+`)
+
+const redisKeyPrefix = "ratelimit:"
+
+// RedisStore keeps buckets in Redis, or anything that speaks its protocol
+// and supports Lua scripts, so that every instance of the API shares them.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore connects lazily to the server at a URL of the form
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS.
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: %w", err)
+	}
+
+	// A slow limiter delays every request, so give up quickly and let the
+	// caller decide what to do without it.
+	opts.DialTimeout = time.Second
+	opts.ReadTimeout = time.Second
+	opts.WriteTimeout = time.Second
+
+	return &RedisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	n, err := takeScript.Run(ctx, s.client, []string{redisKeyPrefix + key}, limit.Rate, limit.Burst).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(n) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply %v", n)
+	}
+
+	return Result{
+		Allowed:    n[0] == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(n[1]),
+		RetryAfter: time.Duration(n[2]) * time.Millisecond,
+		Reset:      time.Duration(n[3]) * time.Millisecond,
+	}, nil
+}
+
+// Ping checks that the server can be reached.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Close closes the connections to the server.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,124 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the RFC 6238 test vectors, base32 encoded.
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateRFCVectors(t *testing.T) {
+	// The last six digits of the RFC 6238 appendix B values for SHA-1.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := Validate(rfcSecret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("code %s rejected at %d", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / Period; step != want {
+			t.Errorf("code %s matched step %d; want %d", tt.code, step, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	key := []byte("12345678901234567890")
+	current := now.Unix() / Period
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"current step", rfcSecret, generate(key, current), true},
+		{"previous step", rfcSecret, generate(key, current-1), true},
+		{"next step", rfcSecret, generate(key, current+1), true},
+		{"two steps ago", rfcSecret, generate(key, current-2), false},
+		{"two steps ahead", rfcSecret, generate(key, current+2), false},
+		{"lowercase secret", strings.ToLower(rfcSecret), generate(key, current), true},
+		{"short code", rfcSecret, "00592", false},
+		{"long code", rfcSecret, "0059240", false},
+		{"empty code", rfcSecret, "", false},
+		{"invalid secret", "not base32!", "005924", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Validate(tt.secret, tt.code, now); ok != tt.ok {
+				t.Errorf("got %t; want %t", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Error("two secrets are the same")
+	}
+
+	key, err := encoding.DecodeString(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("got a %d byte key; want 20", len(key))
+	}
+
+	now := time.Now()
+	if _, ok := Validate(a, generate(key, now.Unix()/Period), now); !ok {
+		t.Error("code for a generated secret rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("JBSWY3DPEHPK3PXP", "Marvel Shop", "peter@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("got %s://%s", u.Scheme, u.Host)
+	}
+	if u.Path != "/Marvel Shop:peter@example.com" {
+		t.Errorf("got label %q", u.Path)
+	}
+
+	want := map[string]string{
+		"secret":    "JBSWY3DPEHPK3PXP",
+		"issuer":    "Marvel Shop",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for k, v := range want {
+		if got := u.Query().Get(k); got != v {
+			t.Errorf("%s = %q; want %q", k, got, v)
+		}
+	}
+}